@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"golang.org/x/net/context"
+)
+
+// runAgent collects the containers of the local node from its cgroup
+// files every agent interval until SIGTERM or SIGINT.
+func runAgent(srv *http.Server) {
+	interval := time.Duration(conf.Agent.Interval) * time.Second
+	reader := newCgroupReader(conf.Agent.CgroupRoot, conf.Agent.ProcRoot)
+	cache := newMemoryStatsCache(3 * interval)
+	log.Printf("agent of node %s, cgroup v2:%v", conf.Agent.NodeId, reader.unified)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	for {
+		pts := collectLocalNode(reader, cache)
+		if len(pts) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			err := metricSink.Write(ctx, pts)
+			cancel()
+			if err != nil {
+				log.Printf("write points (%d) failed!err:=%v", len(pts), err)
+			} else {
+				log.Printf("write points! pts:%d", len(pts))
+			}
+		}
+		select {
+		case sig := <-stop:
+			log.Printf("received %v, shutting down", sig)
+			if err := metricSink.Close(); err != nil {
+				log.Println("close sink failed!err:=", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Println("shutdown http server failed!err:=", err)
+			}
+			cancel()
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// collectLocalNode builds the samples of every selected container of the
+// local node. Rates are computed against the frame of the previous run
+// kept in cache.
+func collectLocalNode(reader *cgroupReader, cache statsCache) []Sample {
+	containers, err := listLocalContainers(conf.Agent.DockerRoot)
+	if err != nil {
+		log.Printf("list local containers failed!err:=%v", err)
+		return nil
+	}
+	pts := make([]Sample, 0)
+	for _, lc := range containers {
+		if !containerSelector.Match(lc.Config.Labels) {
+			continue
+		}
+		c, info := lc.inspect()
+		tags := containerTags(conf.Agent.NodeId, c)
+		pts = append(pts, newSample("docker_container_info", tags, containerInfoFields(c, info)))
+		if info.State.Health != nil {
+			pts = append(pts, newSample("docker_container_health", tags, healthFields(info.State.Health)))
+		}
+		if !info.State.Running || info.State.Pid == 0 {
+			continue
+		}
+		cur, err := reader.Stats(info.State.Pid, info.HostConfig.NetworkMode.IsHost())
+		if err != nil {
+			log.Printf("read container stats(%s) failed!err:=%v", c.ID, err)
+			fields := map[string]interface{}{"error": err.Error()}
+			pts = append(pts, newSample("docker_container_collect_error", tags, fields))
+			continue
+		}
+		prev, _ := cache.Swap(c.ID, cur)
+		if prev == nil {
+			prev = cur
+		}
+		// The engine reports the CPU usage of the previous read with
+		// every frame.
+		cur.PreCPUStats = prev.CPUStats
+		pts = append(pts, containerSamples(tags, info, prev, cur)...)
+	}
+	return pts
+}
+
+// localContainer is the part of the state the engine keeps of a container
+// in config.v2.json under its data root that the samples need.
+type localContainer struct {
+	ID           string
+	Name         string
+	Created      time.Time
+	Image        string
+	RestartCount int
+	State        struct {
+		Running    bool
+		Paused     bool
+		Restarting bool
+		OOMKilled  bool
+		Dead       bool
+		Pid        int
+		ExitCode   int
+		Error      string
+		StartedAt  time.Time
+		FinishedAt time.Time
+		Health     *types.Health
+	}
+	Config struct {
+		Image  string
+		Labels map[string]string
+	}
+	HostConfig container.HostConfig `json:"-"`
+}
+
+// listLocalContainers reads the state of every container of the engine
+// whose data root is dockerRoot. Containers being created or removed may
+// have incomplete files, they are skipped.
+func listLocalContainers(dockerRoot string) ([]*localContainer, error) {
+	dir := filepath.Join(dockerRoot, "containers")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]*localContainer, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		lc := new(localContainer)
+		data, err := ioutil.ReadFile(filepath.Join(dir, e.Name(), "config.v2.json"))
+		if err == nil {
+			err = json.Unmarshal(data, lc)
+		}
+		if err != nil {
+			log.Printf("read container config(%s) failed!err:=%v", e.Name(), err)
+			continue
+		}
+		data, err = ioutil.ReadFile(filepath.Join(dir, e.Name(), "hostconfig.json"))
+		if err == nil {
+			err = json.Unmarshal(data, &lc.HostConfig)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("read container host config(%s) failed!err:=%v", e.Name(), err)
+		}
+		containers = append(containers, lc)
+	}
+	return containers, nil
+}
+
+// status returns the state name the engine reports for the container.
+func (lc *localContainer) status() string {
+	st := lc.State
+	switch {
+	case st.Running && st.Paused:
+		return "paused"
+	case st.Running && st.Restarting:
+		return "restarting"
+	case st.Running:
+		return "running"
+	case st.Dead:
+		return "dead"
+	case st.StartedAt.IsZero():
+		return "created"
+	}
+	return "exited"
+}
+
+// inspect returns the container as the list and inspect endpoints of the
+// engine would.
+func (lc *localContainer) inspect() (types.Container, types.ContainerJSON) {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+	status := lc.status()
+	c := types.Container{
+		ID:     lc.ID,
+		Names:  []string{lc.Name},
+		Image:  lc.Config.Image,
+		Labels: lc.Config.Labels,
+		State:  status,
+		Status: status,
+	}
+	hostConfig := lc.HostConfig
+	info := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:           lc.ID,
+			Created:      formatTime(lc.Created),
+			Image:        lc.Image,
+			Name:         lc.Name,
+			RestartCount: lc.RestartCount,
+			HostConfig:   &hostConfig,
+			State: &types.ContainerState{
+				Status:     status,
+				Running:    lc.State.Running,
+				Paused:     lc.State.Paused,
+				Restarting: lc.State.Restarting,
+				OOMKilled:  lc.State.OOMKilled,
+				Dead:       lc.State.Dead,
+				Pid:        lc.State.Pid,
+				ExitCode:   lc.State.ExitCode,
+				Error:      lc.State.Error,
+				StartedAt:  formatTime(lc.State.StartedAt),
+				FinishedAt: formatTime(lc.State.FinishedAt),
+				Health:     lc.State.Health,
+			},
+		},
+		Config: &container.Config{
+			Image:  lc.Config.Image,
+			Labels: lc.Config.Labels,
+		},
+	}
+	return c, info
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// userHZ is the clock tick of cpuacct.stat and /proc/stat, fixed at 100 on
+// Linux whatever the kernel's HZ.
+const userHZ = 100
+
+// cgroupReader reads the stats of a container from the cgroup and proc
+// files of the local node into the frame the engine's stats endpoint
+// returns, so agent mode emits the same samples as the collector.
+type cgroupReader struct {
+	cgroupRoot string
+	procRoot   string
+	// unified is set on cgroup v2 hosts.
+	unified bool
+}
+
+func newCgroupReader(cgroupRoot string, procRoot string) *cgroupReader {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return &cgroupReader{
+		cgroupRoot: cgroupRoot,
+		procRoot:   procRoot,
+		unified:    err == nil,
+	}
+}
+
+// Stats reads the frame of the container whose init process is pid. The
+// network counters are left out for containers sharing the host network.
+func (r *cgroupReader) Stats(pid int, hostNetwork bool) (*containerStats, error) {
+	paths, err := r.cgroupPaths(pid)
+	if err != nil {
+		return nil, err
+	}
+	s := new(containerStats)
+	s.Read = time.Now()
+	s.CPUStats.SystemCPUUsage, s.OnlineCPUs, err = r.systemCPU()
+	if err != nil {
+		return nil, err
+	}
+	if r.unified {
+		err = r.readUnified(filepath.Join(r.cgroupRoot, paths[""]), s)
+	} else {
+		err = r.readV1(paths, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if limit := r.memTotal(); limit > 0 && (s.MemoryStats.Limit == 0 || s.MemoryStats.Limit > limit) {
+		// Unlimited, report the memory of the node like the engine.
+		s.MemoryStats.Limit = limit
+	}
+	if !hostNetwork {
+		s.Networks, err = r.networks(pid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// cgroupPaths maps the v1 subsystems to the cgroup of pid, the v2 cgroup
+// is under the empty name.
+func (r *cgroupReader) cgroupPaths(pid int) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			paths[""] = parts[2]
+			continue
+		}
+		for _, subsystem := range strings.Split(parts[1], ",") {
+			paths[subsystem] = parts[2]
+		}
+	}
+	return paths, nil
+}
+
+func (r *cgroupReader) readV1(paths map[string]string, s *containerStats) error {
+	dir := func(subsystem string) string {
+		return filepath.Join(r.cgroupRoot, subsystem, paths[subsystem])
+	}
+	var err error
+	cpu := &s.CPUStats
+	if cpu.CPUUsage.TotalUsage, err = readCgroupUint(dir("cpuacct"), "cpuacct.usage"); err != nil {
+		return err
+	}
+	if cpu.CPUUsage.PercpuUsage, err = readCgroupUints(dir("cpuacct"), "cpuacct.usage_percpu"); err != nil {
+		return err
+	}
+	ticks, err := readCgroupKeyValues(dir("cpuacct"), "cpuacct.stat")
+	if err != nil {
+		return err
+	}
+	cpu.CPUUsage.UsageInUsermode = ticks["user"] * (1e9 / userHZ)
+	cpu.CPUUsage.UsageInKernelmode = ticks["system"] * (1e9 / userHZ)
+	throttling, err := readCgroupKeyValues(dir("cpu"), "cpu.stat")
+	if err != nil {
+		return err
+	}
+	cpu.ThrottlingData.Periods = throttling["nr_periods"]
+	cpu.ThrottlingData.ThrottledPeriods = throttling["nr_throttled"]
+	cpu.ThrottlingData.ThrottledTime = throttling["throttled_time"]
+
+	mem := &s.MemoryStats
+	if mem.Usage, err = readCgroupUint(dir("memory"), "memory.usage_in_bytes"); err != nil {
+		return err
+	}
+	if mem.MaxUsage, err = readCgroupUint(dir("memory"), "memory.max_usage_in_bytes"); err != nil {
+		return err
+	}
+	if mem.Failcnt, err = readCgroupUint(dir("memory"), "memory.failcnt"); err != nil {
+		return err
+	}
+	if mem.Limit, err = readCgroupUint(dir("memory"), "memory.limit_in_bytes"); err != nil {
+		return err
+	}
+	stat, err := readCgroupKeyValues(dir("memory"), "memory.stat")
+	if err != nil {
+		return err
+	}
+	if err = setMemoryStat(s, stat); err != nil {
+		return err
+	}
+
+	blkio := &s.BlkioStats
+	for _, f := range []struct {
+		entries *[]docker.BlkioStatsEntry
+		name    string
+	}{
+		{&blkio.IOServiceBytesRecursive, "io_service_bytes_recursive"},
+		{&blkio.IOServicedRecursive, "io_serviced_recursive"},
+		{&blkio.IOQueueRecursive, "io_queue_recursive"},
+		{&blkio.IOServiceTimeRecursive, "io_service_time_recursive"},
+		{&blkio.IOWaitTimeRecursive, "io_wait_time_recursive"},
+		{&blkio.IOMergedRecursive, "io_merged_recursive"},
+		{&blkio.IOTimeRecursive, "time_recursive"},
+		{&blkio.SectorsRecursive, "sectors_recursive"},
+	} {
+		if *f.entries, err = readBlkioEntries(dir("blkio"), "blkio."+f.name); err != nil {
+			return err
+		}
+	}
+	// Without CFQ the kernel only counts in the throttle files, the
+	// engine falls back to them as well.
+	if len(blkio.IOServiceBytesRecursive) == 0 {
+		if blkio.IOServiceBytesRecursive, err = readBlkioEntries(dir("blkio"), "blkio.throttle.io_service_bytes"); err != nil {
+			return err
+		}
+		if blkio.IOServicedRecursive, err = readBlkioEntries(dir("blkio"), "blkio.throttle.io_serviced"); err != nil {
+			return err
+		}
+	}
+
+	if s.PidsStats.Current, err = readCgroupUint(dir("pids"), "pids.current"); err != nil {
+		return err
+	}
+	s.PidsLimit, err = readCgroupUint(dir("pids"), "pids.max")
+	return err
+}
+
+// memoryStatV2 maps the memory.stat keys of cgroup v2 to their v1 name.
+var memoryStatV2 = map[string]string{
+	"anon":           "rss",
+	"file":           "cache",
+	"file_mapped":    "mapped_file",
+	"file_writeback": "writeback",
+	"active_anon":    "active_anon",
+	"inactive_anon":  "inactive_anon",
+	"active_file":    "active_file",
+	"inactive_file":  "inactive_file",
+	"unevictable":    "unevictable",
+	"pgfault":        "pgfault",
+	"pgmajfault":     "pgmajfault",
+}
+
+func (r *cgroupReader) readUnified(dir string, s *containerStats) error {
+	cpuStat, err := readCgroupKeyValues(dir, "cpu.stat")
+	if err != nil {
+		return err
+	}
+	cpu := &s.CPUStats
+	cpu.CPUUsage.TotalUsage = cpuStat["usage_usec"] * 1000
+	cpu.CPUUsage.UsageInUsermode = cpuStat["user_usec"] * 1000
+	cpu.CPUUsage.UsageInKernelmode = cpuStat["system_usec"] * 1000
+	cpu.ThrottlingData.Periods = cpuStat["nr_periods"]
+	cpu.ThrottlingData.ThrottledPeriods = cpuStat["nr_throttled"]
+	cpu.ThrottlingData.ThrottledTime = cpuStat["throttled_usec"] * 1000
+
+	mem := &s.MemoryStats
+	if mem.Usage, err = readCgroupUint(dir, "memory.current"); err != nil {
+		return err
+	}
+	if mem.MaxUsage, err = readCgroupUint(dir, "memory.peak"); err != nil {
+		return err
+	}
+	if mem.Limit, err = readCgroupUint(dir, "memory.max"); err != nil {
+		return err
+	}
+	stat, err := readCgroupKeyValues(dir, "memory.stat")
+	if err != nil {
+		return err
+	}
+	v1 := make(map[string]uint64, len(memoryStatV2)+1)
+	for k, name := range memoryStatV2 {
+		v1[name] = stat[k]
+	}
+	if v1["swap"], err = readCgroupUint(dir, "memory.swap.current"); err != nil {
+		return err
+	}
+	if err = setMemoryStat(s, v1); err != nil {
+		return err
+	}
+
+	if err = readIoStat(dir, s); err != nil {
+		return err
+	}
+
+	if s.PidsStats.Current, err = readCgroupUint(dir, "pids.current"); err != nil {
+		return err
+	}
+	s.PidsLimit, err = readCgroupUint(dir, "pids.max")
+	return err
+}
+
+// setMemoryStat fills the memory.stat breakdown, whose JSON names are the
+// v1 memory.stat keys.
+func setMemoryStat(s *containerStats, stat map[string]uint64) error {
+	s.TotalSwap = stat["total_swap"]
+	data, err := json.Marshal(stat)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.MemoryStats.Stats)
+}
+
+// readIoStat converts the v2 io.stat lines, as in
+// "8:0 rbytes=1 wbytes=2 rios=3 wios=4", to blkio entries.
+func readIoStat(dir string, s *containerStats) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "io.stat"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	blkio := &s.BlkioStats
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 2 {
+			continue
+		}
+		var major, minor uint64
+		if _, err := fmt.Sscanf(parts[0], "%d:%d", &major, &minor); err != nil {
+			continue
+		}
+		for _, kv := range parts[1:] {
+			i := strings.Index(kv, "=")
+			if i < 0 {
+				continue
+			}
+			v, err := strconv.ParseUint(kv[i+1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			e := docker.BlkioStatsEntry{Major: major, Minor: minor, Value: v}
+			switch kv[:i] {
+			case "rbytes":
+				e.Op = "read"
+				blkio.IOServiceBytesRecursive = append(blkio.IOServiceBytesRecursive, e)
+			case "wbytes":
+				e.Op = "write"
+				blkio.IOServiceBytesRecursive = append(blkio.IOServiceBytesRecursive, e)
+			case "rios":
+				e.Op = "read"
+				blkio.IOServicedRecursive = append(blkio.IOServicedRecursive, e)
+			case "wios":
+				e.Op = "write"
+				blkio.IOServicedRecursive = append(blkio.IOServicedRecursive, e)
+			}
+		}
+	}
+	return nil
+}
+
+// systemCPU returns the CPU time of the node in nanoseconds, summed like
+// the engine does, and the number of online CPUs.
+func (r *cgroupReader) systemCPU() (uint64, uint32, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.procRoot, "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	var total uint64
+	var online uint32
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) == 0 || !strings.HasPrefix(parts[0], "cpu") {
+			continue
+		}
+		if parts[0] != "cpu" {
+			online++
+			continue
+		}
+		if len(parts) < 8 {
+			return 0, 0, fmt.Errorf("invalid cpu line %q in /proc/stat", line)
+		}
+		for _, f := range parts[1:8] {
+			v, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid cpu line %q in /proc/stat", line)
+			}
+			total += v
+		}
+	}
+	return total * (1e9 / userHZ), online, nil
+}
+
+// memTotal returns the memory of the node in bytes, zero if unknown.
+func (r *cgroupReader) memTotal() uint64 {
+	data, err := ioutil.ReadFile(filepath.Join(r.procRoot, "meminfo"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) >= 2 && parts[0] == "MemTotal:" {
+			kb, _ := strconv.ParseUint(parts[1], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// networks reads the interface counters of the network namespace of pid,
+// leaving out the loopback like the engine.
+func (r *cgroupReader) networks(pid int) (map[string]docker.NetworkStats, error) {
+	f, err := os.Open(filepath.Join(r.procRoot, strconv.Itoa(pid), "net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	networks := make(map[string]docker.NetworkStats)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, ":")
+		if i < 0 {
+			// Header lines.
+			continue
+		}
+		name := strings.TrimSpace(line[:i])
+		parts := strings.Fields(line[i+1:])
+		if name == "lo" || len(parts) < 12 {
+			continue
+		}
+		v := make([]uint64, 12)
+		for j := range v {
+			v[j], _ = strconv.ParseUint(parts[j], 10, 64)
+		}
+		networks[name] = docker.NetworkStats{
+			RxBytes:   v[0],
+			RxPackets: v[1],
+			RxErrors:  v[2],
+			RxDropped: v[3],
+			TxBytes:   v[8],
+			TxPackets: v[9],
+			TxErrors:  v[10],
+			TxDropped: v[11],
+		}
+	}
+	return networks, scanner.Err()
+}
+
+// The readCgroup* helpers read a cgroup file in dir. A missing file reads
+// as zero since controllers may be disabled or unknown to the kernel, and
+// "max" reads as zero meaning unlimited.
+
+func readCgroupUint(dir string, name string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v := strings.TrimSpace(string(data))
+	if v == "max" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		// -1 also means unlimited in some v1 files.
+		if _, ierr := strconv.ParseInt(v, 10, 64); ierr == nil {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("parse %s: %v", filepath.Join(dir, name), err)
+	}
+	return n, nil
+}
+
+func readCgroupUints(dir string, name string) ([]uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var values []uint64
+	for _, f := range strings.Fields(string(data)) {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %v", filepath.Join(dir, name), err)
+		}
+		values = append(values, n)
+	}
+	return values, nil
+}
+
+func readCgroupKeyValues(dir string, name string) (map[string]uint64, error) {
+	values := make(map[string]uint64)
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[parts[0]] = n
+	}
+	return values, nil
+}
+
+// readBlkioEntries reads a v1 blkio file with lines as in "8:0 Read 4096"
+// or "8:0 4096", leaving out the Total line.
+func readBlkioEntries(dir string, name string) ([]docker.BlkioStatsEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []docker.BlkioStatsEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 2 {
+			continue
+		}
+		var e docker.BlkioStatsEntry
+		if _, err := fmt.Sscanf(parts[0], "%d:%d", &e.Major, &e.Minor); err != nil {
+			continue
+		}
+		if len(parts) == 3 {
+			e.Op = parts[1]
+		}
+		e.Value, err = strconv.ParseUint(parts[len(parts)-1], 10, 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// writeTree creates the files of tree, keyed by their path relative to
+// root.
+func writeTree(t *testing.T, root string, tree map[string]string) {
+	for name, data := range tree {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+const (
+	testProcStat = "cpu  100 0 50 800 10 0 40 0 0 0\ncpu0 50 0 25 400 5 0 20 0 0 0\ncpu1 50 0 25 400 5 0 20 0 0 0\nintr 1 2 3\n"
+	testMeminfo  = "MemTotal:        2048 kB\nMemFree:         1024 kB\n"
+	testNetDev   = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:     500       5    0    0    0     0          0         0      500       5    0    0    0     0       0          0
+  eth0:    1000      10    1    2    0     0          0         0     2000      20    3    4    0     0       0          0
+`
+)
+
+// testProc returns the proc files of pid 42 in the cgroups of cgroup.
+func testProc(cgroup string) map[string]string {
+	return map[string]string{
+		"stat":       testProcStat,
+		"meminfo":    testMeminfo,
+		"42/cgroup":  cgroup,
+		"42/net/dev": testNetDev,
+	}
+}
+
+// tempDir creates a directory for a test, removed by the returned func.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "metrics-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// newTestReader returns a reader of the cgroup and proc trees, removed by
+// the returned func.
+func newTestReader(t *testing.T, cgroup map[string]string, proc map[string]string) (*cgroupReader, func()) {
+	root, cleanup := tempDir(t)
+	writeTree(t, filepath.Join(root, "cgroup"), cgroup)
+	writeTree(t, filepath.Join(root, "proc"), proc)
+	return newCgroupReader(filepath.Join(root, "cgroup"), filepath.Join(root, "proc")), cleanup
+}
+
+func TestCgroupReaderV1(t *testing.T) {
+	const cg = "/docker/abc"
+	r, cleanup := newTestReader(t, map[string]string{
+		"cpuacct" + cg + "/cpuacct.usage":                  "3000000000\n",
+		"cpuacct" + cg + "/cpuacct.usage_percpu":           "1000000000 2000000000 \n",
+		"cpuacct" + cg + "/cpuacct.stat":                   "user 200\nsystem 100\n",
+		"cpu" + cg + "/cpu.stat":                           "nr_periods 10\nnr_throttled 2\nthrottled_time 5000\n",
+		"memory" + cg + "/memory.usage_in_bytes":           "1024\n",
+		"memory" + cg + "/memory.max_usage_in_bytes":       "1536\n",
+		"memory" + cg + "/memory.failcnt":                  "3\n",
+		"memory" + cg + "/memory.limit_in_bytes":           "9223372036854771712\n",
+		"memory" + cg + "/memory.stat":                     "cache 100\nrss 200\nswap 5\ninactive_file 40\ntotal_rss 300\n",
+		"blkio" + cg + "/blkio.io_service_bytes_recursive": "Total 0\n",
+		"blkio" + cg + "/blkio.throttle.io_service_bytes":  "8:0 Read 4096\n8:0 Write 8192\n8:0 Total 12288\nTotal 12288\n",
+		"blkio" + cg + "/blkio.throttle.io_serviced":       "8:0 Read 1\n8:0 Write 2\n8:0 Total 3\nTotal 3\n",
+		"pids" + cg + "/pids.current":                      "7\n",
+		"pids" + cg + "/pids.max":                          "max\n",
+		"blkio" + cg + "/blkio.sectors_recursive":          "8:0 16\n",
+	}, testProc("12:pids:"+cg+"\n11:blkio:"+cg+"\n4:memory:"+cg+"\n3:cpu,cpuacct:"+cg+"\n1:name=systemd:"+cg+"\n"))
+	defer cleanup()
+	if r.unified {
+		t.Fatal("v1 tree detected as unified")
+	}
+	s, err := r.Stats(42, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cpu := s.CPUStats
+	if cpu.CPUUsage.TotalUsage != 3000000000 {
+		t.Errorf("total usage %d", cpu.CPUUsage.TotalUsage)
+	}
+	if !reflect.DeepEqual(cpu.CPUUsage.PercpuUsage, []uint64{1000000000, 2000000000}) {
+		t.Errorf("percpu usage %v", cpu.CPUUsage.PercpuUsage)
+	}
+	if cpu.CPUUsage.UsageInUsermode != 2000000000 || cpu.CPUUsage.UsageInKernelmode != 1000000000 {
+		t.Errorf("user/kernel usage %d/%d", cpu.CPUUsage.UsageInUsermode, cpu.CPUUsage.UsageInKernelmode)
+	}
+	// user+nice+system+idle+iowait+irq+softirq ticks of the cpu line.
+	if cpu.SystemCPUUsage != 1000*1e7 || s.OnlineCPUs != 2 {
+		t.Errorf("system usage %d, online cpus %d", cpu.SystemCPUUsage, s.OnlineCPUs)
+	}
+	if cpu.ThrottlingData.Periods != 10 || cpu.ThrottlingData.ThrottledPeriods != 2 || cpu.ThrottlingData.ThrottledTime != 5000 {
+		t.Errorf("throttling %+v", cpu.ThrottlingData)
+	}
+
+	mem := s.MemoryStats
+	if mem.Usage != 1024 || mem.MaxUsage != 1536 || mem.Failcnt != 3 {
+		t.Errorf("memory usage %d, max %d, failcnt %d", mem.Usage, mem.MaxUsage, mem.Failcnt)
+	}
+	// The unlimited limit is capped to MemTotal.
+	if mem.Limit != 2048*1024 {
+		t.Errorf("memory limit %d", mem.Limit)
+	}
+	if mem.Stats.Cache != 100 || mem.Stats.Rss != 200 || mem.Stats.Swap != 5 || mem.Stats.InactiveFile != 40 || mem.Stats.TotalRss != 300 {
+		t.Errorf("memory stat %+v", mem.Stats)
+	}
+
+	wantIO := []docker.BlkioStatsEntry{
+		{Major: 8, Minor: 0, Op: "Read", Value: 4096},
+		{Major: 8, Minor: 0, Op: "Write", Value: 8192},
+		{Major: 8, Minor: 0, Op: "Total", Value: 12288},
+	}
+	if !reflect.DeepEqual(s.BlkioStats.IOServiceBytesRecursive, wantIO) {
+		t.Errorf("io service bytes %+v", s.BlkioStats.IOServiceBytesRecursive)
+	}
+	if len(s.BlkioStats.IOServicedRecursive) != 3 || s.BlkioStats.IOServicedRecursive[1].Value != 2 {
+		t.Errorf("io serviced %+v", s.BlkioStats.IOServicedRecursive)
+	}
+	if !reflect.DeepEqual(s.BlkioStats.SectorsRecursive, []docker.BlkioStatsEntry{{Major: 8, Minor: 0, Value: 16}}) {
+		t.Errorf("sectors %+v", s.BlkioStats.SectorsRecursive)
+	}
+
+	if s.PidsStats.Current != 7 || s.PidsLimit != 0 {
+		t.Errorf("pids %d of %d", s.PidsStats.Current, s.PidsLimit)
+	}
+	want := map[string]docker.NetworkStats{"eth0": {
+		RxBytes: 1000, RxPackets: 10, RxErrors: 1, RxDropped: 2,
+		TxBytes: 2000, TxPackets: 20, TxErrors: 3, TxDropped: 4,
+	}}
+	if !reflect.DeepEqual(s.Networks, want) {
+		t.Errorf("networks %+v", s.Networks)
+	}
+}
+
+func TestCgroupReaderV2(t *testing.T) {
+	const cg = "system.slice/docker-abc.scope"
+	tests := []struct {
+		name      string
+		files     map[string]string
+		limit     uint64
+		pidsLimit uint64
+	}{
+		{
+			name: "limited",
+			files: map[string]string{
+				cg + "/memory.max": "1048576\n",
+				cg + "/pids.max":   "100\n",
+			},
+			limit:     1048576,
+			pidsLimit: 100,
+		},
+		{
+			name: "unlimited",
+			files: map[string]string{
+				cg + "/memory.max": "max\n",
+				cg + "/pids.max":   "max\n",
+			},
+			limit: 2048 * 1024,
+		},
+	}
+	for _, tt := range tests {
+		files := map[string]string{
+			"cgroup.controllers":        "cpu io memory pids\n",
+			cg + "/cpu.stat":            "usage_usec 3000\nuser_usec 2000\nsystem_usec 1000\nnr_periods 10\nnr_throttled 2\nthrottled_usec 5\n",
+			cg + "/memory.current":      "4096\n",
+			cg + "/memory.peak":         "8192\n",
+			cg + "/memory.stat":         "anon 300\nfile 200\nfile_mapped 10\ninactive_file 50\nactive_file 150\npgmajfault 2\nsock 0\n",
+			cg + "/memory.swap.current": "7\n",
+			cg + "/io.stat":             "8:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n253:1 rbytes=1 wbytes=0 rios=1 wios=0\n",
+			cg + "/pids.current":        "3\n",
+		}
+		for k, v := range tt.files {
+			files[k] = v
+		}
+		r, cleanup := newTestReader(t, files, testProc("0::/"+cg+"\n"))
+		defer cleanup()
+		if !r.unified {
+			t.Fatalf("%s: v2 tree not detected as unified", tt.name)
+		}
+		s, err := r.Stats(42, true)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		cpu := s.CPUStats
+		if cpu.CPUUsage.TotalUsage != 3000000 || cpu.CPUUsage.UsageInUsermode != 2000000 || cpu.CPUUsage.UsageInKernelmode != 1000000 {
+			t.Errorf("%s: cpu usage %+v", tt.name, cpu.CPUUsage)
+		}
+		if cpu.ThrottlingData.Periods != 10 || cpu.ThrottlingData.ThrottledPeriods != 2 || cpu.ThrottlingData.ThrottledTime != 5000 {
+			t.Errorf("%s: throttling %+v", tt.name, cpu.ThrottlingData)
+		}
+
+		mem := s.MemoryStats
+		if mem.Usage != 4096 || mem.MaxUsage != 8192 || mem.Limit != tt.limit {
+			t.Errorf("%s: memory usage %d, max %d, limit %d", tt.name, mem.Usage, mem.MaxUsage, mem.Limit)
+		}
+		st := mem.Stats
+		if st.Rss != 300 || st.Cache != 200 || st.MappedFile != 10 || st.InactiveFile != 50 || st.ActiveFile != 150 || st.Pgmajfault != 2 || st.Swap != 7 {
+			t.Errorf("%s: memory stat %+v", tt.name, st)
+		}
+
+		wantBytes := []docker.BlkioStatsEntry{
+			{Major: 8, Minor: 0, Op: "read", Value: 4096},
+			{Major: 8, Minor: 0, Op: "write", Value: 8192},
+			{Major: 253, Minor: 1, Op: "read", Value: 1},
+			{Major: 253, Minor: 1, Op: "write", Value: 0},
+		}
+		if !reflect.DeepEqual(s.BlkioStats.IOServiceBytesRecursive, wantBytes) {
+			t.Errorf("%s: io service bytes %+v", tt.name, s.BlkioStats.IOServiceBytesRecursive)
+		}
+		if len(s.BlkioStats.IOServicedRecursive) != 4 || s.BlkioStats.IOServicedRecursive[1].Value != 2 {
+			t.Errorf("%s: io serviced %+v", tt.name, s.BlkioStats.IOServicedRecursive)
+		}
+
+		if s.PidsStats.Current != 3 || s.PidsLimit != tt.pidsLimit {
+			t.Errorf("%s: pids %d of %d", tt.name, s.PidsStats.Current, s.PidsLimit)
+		}
+		// Host network containers have no counters of their own.
+		if s.Networks != nil {
+			t.Errorf("%s: networks %+v for a host network container", tt.name, s.Networks)
+		}
+	}
+}
+
+func TestReadCgroupUint(t *testing.T) {
+	tests := []struct {
+		data    string
+		missing bool
+		want    uint64
+		err     bool
+	}{
+		{data: "42\n", want: 42},
+		{data: "max\n", want: 0},
+		{data: "-1\n", want: 0},
+		{missing: true, want: 0},
+		{data: "lots\n", err: true},
+	}
+	for _, tt := range tests {
+		dir, cleanup := tempDir(t)
+		defer cleanup()
+		if !tt.missing {
+			writeTree(t, dir, map[string]string{"f": tt.data})
+		}
+		got, err := readCgroupUint(dir, "f")
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("readCgroupUint(%q) = %d, %v; want %d, error %v", tt.data, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestCgroupReaderNetworks(t *testing.T) {
+	tests := []struct {
+		name string
+		dev  string
+		want map[string]docker.NetworkStats
+	}{
+		{
+			name: "loopback and headers skipped",
+			dev:  testNetDev,
+			want: map[string]docker.NetworkStats{"eth0": {
+				RxBytes: 1000, RxPackets: 10, RxErrors: 1, RxDropped: 2,
+				TxBytes: 2000, TxPackets: 20, TxErrors: 3, TxDropped: 4,
+			}},
+		},
+		{
+			name: "several interfaces without spaces after the colon",
+			dev: "h1\nh2\n" +
+				"eth0:1 2 3 4 0 0 0 0 5 6 7 8 0 0 0 0\n" +
+				"  eth1: 10 20 30 40 0 0 0 0 50 60 70 80 0 0 0 0\n" +
+				"short: 1 2 3\n",
+			want: map[string]docker.NetworkStats{
+				"eth0": {RxBytes: 1, RxPackets: 2, RxErrors: 3, RxDropped: 4, TxBytes: 5, TxPackets: 6, TxErrors: 7, TxDropped: 8},
+				"eth1": {RxBytes: 10, RxPackets: 20, RxErrors: 30, RxDropped: 40, TxBytes: 50, TxPackets: 60, TxErrors: 70, TxDropped: 80},
+			},
+		},
+		{
+			name: "only loopback",
+			dev:  "h1\nh2\n    lo: 1 1 0 0 0 0 0 0 1 1 0 0 0 0 0 0\n",
+			want: map[string]docker.NetworkStats{},
+		},
+	}
+	for _, tt := range tests {
+		r, cleanup := newTestReader(t, nil, map[string]string{"42/net/dev": tt.dev})
+		defer cleanup()
+		got, err := r.networks(42)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	r, cleanup := newTestReader(t, nil, nil)
+	defer cleanup()
+	if _, err := r.networks(42); err == nil {
+		t.Error("expected an error for a missing net/dev")
+	}
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	// Mode is collector to collect all nodes through their tunnels, or
+	// agent to collect the local node from its cgroup files.
+	Mode        string            `yaml:"mode"`
+	Listen      string            `yaml:"listen"`
+	Production  bool              `yaml:"production"`
+	StackImpact StackImpactConfig `yaml:"stackimpact"`
+	Mysql       MysqlConfig       `yaml:"mysql"`
+	Redis       RedisConfig       `yaml:"redis"`
+	Sinks       []string          `yaml:"sinks"`
+	Influx      InfluxConfig      `yaml:"influx"`
+	Prometheus  PrometheusConfig  `yaml:"prometheus"`
+	Collector   CollectorConfig   `yaml:"collector"`
+	Containers  ContainersConfig  `yaml:"containers"`
+	Agent       AgentConfig       `yaml:"agent"`
+	Ingest      IngestConfig      `yaml:"ingest"`
+	Push        PushConfig        `yaml:"push"`
+}
+
+type StackImpactConfig struct {
+	AgentKey string `yaml:"agent_key"`
+	AppName  string `yaml:"app_name"`
+}
+
+type MysqlConfig struct {
+	DaoKeeper string `yaml:"daokeeper"`
+	DaoSR     string `yaml:"daosr"`
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+type InfluxConfig struct {
+	Addr string `yaml:"addr"`
+	// Version selects the write API, 1 for /write and 2 for /api/v2/write.
+	Version int `yaml:"version"`
+	// Precision is one of ns, us, ms or s.
+	Precision string `yaml:"precision"`
+	Gzip      bool   `yaml:"gzip"`
+	// Timeout is the HTTP timeout in seconds.
+	Timeout int64 `yaml:"timeout"`
+
+	// 1.x settings.
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention_policy"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+
+	// 2.x settings.
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	Token  string `yaml:"token"`
+}
+
+type PrometheusConfig struct {
+	// TTL is the number of seconds a series is exported after its last
+	// update, three times the longest collect interval when zero.
+	TTL int64 `yaml:"ttl"`
+}
+
+type CollectorConfig struct {
+	// CollectInterval is the minimum number of seconds between two
+	// collections of the same node, for nodes without a class.
+	CollectInterval int64 `yaml:"collect_interval"`
+	// Classes are the priority classes nodes are assigned to in the
+	// node_collect_policy table.
+	Classes map[string]CollectClass `yaml:"classes"`
+	// Sleep is the number of seconds between two refreshes of the
+	// connected nodes, new nodes are scheduled at the next refresh.
+	Sleep int64 `yaml:"sleep"`
+	// Workers is the number of nodes collected concurrently.
+	Workers int `yaml:"workers"`
+	// QueueSize bounds the nodes waiting for a worker, further nodes are
+	// dropped until the next scheduling round.
+	QueueSize int `yaml:"queue_size"`
+	// NodeTimeout is the number of seconds the collection of all
+	// containers of a node may take.
+	NodeTimeout int64 `yaml:"node_timeout"`
+	// ContainerConcurrency is the number of containers of a node whose
+	// stats are read in parallel.
+	ContainerConcurrency int `yaml:"container_concurrency"`
+	// ContainerTimeout is the number of seconds the collection of one
+	// container may take.
+	ContainerTimeout int64 `yaml:"container_timeout"`
+	// StatsMode is stream to read two frames of the stats stream per
+	// container, or oneshot to read a single frame and compute rates
+	// against the frame cached at the previous collection. The network
+	// rx_bandwidth and tx_bandwidth deltas span these frames, so they
+	// grow with the interval in oneshot mode; the *_bytes_per_sec rates
+	// do not depend on the mode.
+	StatsMode string `yaml:"stats_mode"`
+	// StatsCache is where oneshot mode keeps frames, memory or redis.
+	StatsCache string `yaml:"stats_cache"`
+	// StatsCacheTTL is the number of seconds a cached frame is used,
+	// three times the longest collect interval when zero.
+	StatsCacheTTL int64 `yaml:"stats_cache_ttl"`
+	// PerCoreCpu adds a docker_container_cpu_core sample per CPU.
+	PerCoreCpu bool `yaml:"per_core_cpu"`
+	// ProcessSnapshotThreshold is the number of pids from which a
+	// container's process list is recorded, zero disables it.
+	ProcessSnapshotThreshold uint64 `yaml:"process_snapshot_threshold"`
+	// ProcessSnapshotLimit bounds the processes recorded per container.
+	ProcessSnapshotLimit int `yaml:"process_snapshot_limit"`
+	// RetryBackoff is the number of seconds before a failed node is
+	// retried, doubled for every consecutive failure up to the node's
+	// interval.
+	RetryBackoff int64 `yaml:"retry_backoff"`
+	// ClaimTimeout is the number of seconds after which a node claimed by
+	// a worker that never reported back becomes eligible again.
+	ClaimTimeout int64 `yaml:"claim_timeout"`
+	// ReplicaId identifies this collector in leases and collection state,
+	// hostname-pid when empty.
+	ReplicaId string `yaml:"replica_id"`
+	// LeaseTTL is the number of seconds a node lease outlives its last
+	// renewal, so the time before a dead replica's node is taken over.
+	LeaseTTL int64 `yaml:"lease_ttl"`
+	// ShutdownTimeout is the number of seconds in-flight collections are
+	// given to finish on SIGTERM or SIGINT.
+	ShutdownTimeout int64 `yaml:"shutdown_timeout"`
+	// Events subscribes to the docker events of every connected node.
+	Events bool `yaml:"events"`
+	// EventActions are the container event actions recorded.
+	EventActions []string `yaml:"event_actions"`
+	// SelfMetrics writes the collector's stage counters to the sinks as
+	// collector_self samples every sleep seconds. The prometheus sink
+	// leaves them out, /metrics serves the counters either way.
+	SelfMetrics bool `yaml:"self_metrics"`
+}
+
+// CollectClass is a priority class of nodes.
+type CollectClass struct {
+	// Interval is the minimum number of seconds between two collections
+	// of a node of the class.
+	Interval int64 `yaml:"interval"`
+	// Priority orders the nodes due at the same time, higher first.
+	// Nodes without a class have priority 0.
+	Priority int `yaml:"priority"`
+}
+
+// maxInterval is the longest collect interval of any node.
+func (c *CollectorConfig) maxInterval() int64 {
+	max := c.CollectInterval
+	for _, class := range c.Classes {
+		if class.Interval > max {
+			max = class.Interval
+		}
+	}
+	return max
+}
+
+// ContainersConfig selects the collected containers by label, see
+// labelSelector for the selector syntax.
+type ContainersConfig struct {
+	// Include selectors must all match.
+	Include []string `yaml:"include"`
+	// Exclude selectors must not match.
+	Exclude []string `yaml:"exclude"`
+	// LabelTags maps container labels to the tag they are written as. The
+	// config file, LABEL_TAGS and -label-tags add to the default mapping,
+	// the latter two drop a label given as label= without a tag. Labels a
+	// container does not have result in no tag.
+	LabelTags map[string]string `yaml:"label_tags"`
+}
+
+// AgentConfig configures agent mode. The roots are the host paths, which
+// differ when the agent runs in a container with them mounted.
+type AgentConfig struct {
+	// NodeId is the node_id tag of the local node.
+	NodeId     string `yaml:"node_id"`
+	CgroupRoot string `yaml:"cgroup_root"`
+	ProcRoot   string `yaml:"proc_root"`
+	DockerRoot string `yaml:"docker_root"`
+	// Interval is the number of seconds between two collections.
+	Interval int64 `yaml:"interval"`
+}
+
+// IngestConfig configures the endpoint nodes push samples to.
+type IngestConfig struct {
+	// Secret enables POST /ingest. A node authenticates with the hex
+	// HMAC-SHA256 of its node id keyed with Secret, as printed by
+	// echo -n <node id> | openssl dgst -sha256 -hmac <secret>.
+	Secret string `yaml:"secret"`
+	// MaxBodySize bounds a request body in bytes, after decompression.
+	MaxBodySize int64 `yaml:"max_body_size"`
+	// Measurements are the measurement prefixes nodes may write.
+	Measurements []string `yaml:"measurements"`
+}
+
+// PushConfig configures the push sink, which sends the samples of an
+// agent to the ingest endpoint of a collector.
+type PushConfig struct {
+	// Addr is the base URL of the collector, as in http://collector:6060.
+	Addr string `yaml:"addr"`
+	// Token is the ingest token of agent.node_id.
+	Token string `yaml:"token"`
+	// Timeout is the HTTP timeout in seconds.
+	Timeout int64 `yaml:"timeout"`
+}
+
+var conf = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Mode:   "collector",
+		Listen: "0.0.0.0:6060",
+		StackImpact: StackImpactConfig{
+			AppName: "sr_metrics",
+		},
+		Sinks: []string{"influx"},
+		Influx: InfluxConfig{
+			Version:   1,
+			Precision: "ns",
+			Timeout:   10,
+			Database:  "daosr",
+		},
+		Collector: CollectorConfig{
+			CollectInterval:      120,
+			Sleep:                6,
+			Workers:              64,
+			QueueSize:            1000,
+			NodeTimeout:          60,
+			ContainerConcurrency: 4,
+			ContainerTimeout:     10,
+			StatsMode:            "stream",
+			StatsCache:           "memory",
+			ProcessSnapshotLimit: 200,
+			RetryBackoff:         10,
+			ClaimTimeout:         60,
+			LeaseTTL:             30,
+			ShutdownTimeout:      30,
+			EventActions:         []string{"die", "oom", "kill", "restart", "health_status"},
+		},
+		Containers: ContainersConfig{
+			Include: []string{"io.daocloud.sr.microservice-id"},
+			LabelTags: map[string]string{
+				"io.daocloud.sr.microservice-id": "micro_service_id",
+			},
+		},
+		Agent: AgentConfig{
+			CgroupRoot: "/sys/fs/cgroup",
+			ProcRoot:   "/proc",
+			DockerRoot: "/var/lib/docker",
+			Interval:   30,
+		},
+		Ingest: IngestConfig{
+			MaxBodySize:  10 << 20,
+			Measurements: []string{"docker_"},
+		},
+		Push: PushConfig{
+			Timeout: 10,
+		},
+	}
+}
+
+// setting binds one configuration key to its environment variable and
+// command line flag. Values are applied in the order defaults, config
+// file, environment, flags.
+type setting struct {
+	key      string
+	env      string
+	flag     string
+	usage    string
+	required bool
+	secret   bool
+	ptr      interface{}
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{key: "mode", env: "MODE", flag: "mode", usage: "collector or agent", ptr: &c.Mode},
+		{key: "listen", env: "LISTEN", flag: "listen", usage: "address of the pprof/metrics HTTP server", ptr: &c.Listen},
+		{key: "production", env: "PROD", flag: "prod", usage: "report as production environment", ptr: &c.Production},
+		{key: "stackimpact.agent_key", env: "STACKIMPACT_AGENT_KEY", flag: "stackimpact-agent-key", usage: "stackimpact agent key, profiling is disabled when empty", secret: true, ptr: &c.StackImpact.AgentKey},
+		{key: "stackimpact.app_name", env: "STACKIMPACT_APP_NAME", flag: "stackimpact-app-name", usage: "stackimpact application name", ptr: &c.StackImpact.AppName},
+		{key: "mysql.daokeeper", env: "DAOKEEPER", flag: "daokeeper", usage: "daokeeper mysql DSN", required: true, secret: true, ptr: &c.Mysql.DaoKeeper},
+		{key: "mysql.daosr", env: "DAOSR", flag: "daosr", usage: "daosr mysql DSN", required: true, secret: true, ptr: &c.Mysql.DaoSR},
+		{key: "redis.addr", env: "REDIS", flag: "redis", usage: "redis address (host:port)", required: true, ptr: &c.Redis.Addr},
+		{key: "redis.password", env: "REDIS_PASSWORD", flag: "redis-password", usage: "redis password", secret: true, ptr: &c.Redis.Password},
+		{key: "redis.db", env: "REDIS_DB", flag: "redis-db", usage: "redis database number", ptr: &c.Redis.DB},
+		{key: "sinks", env: "SINKS", flag: "sinks", usage: "comma separated list of sinks samples are written to", ptr: &c.Sinks},
+		{key: "influx.addr", env: "InfluxAddr", flag: "influx-addr", usage: "influxdb URL", ptr: &c.Influx.Addr},
+		{key: "influx.version", env: "INFLUX_VERSION", flag: "influx-version", usage: "influxdb write API version, 1 or 2", ptr: &c.Influx.Version},
+		{key: "influx.precision", env: "INFLUX_PRECISION", flag: "influx-precision", usage: "timestamp precision, ns, us, ms or s", ptr: &c.Influx.Precision},
+		{key: "influx.gzip", env: "INFLUX_GZIP", flag: "influx-gzip", usage: "gzip write bodies", ptr: &c.Influx.Gzip},
+		{key: "influx.timeout", env: "INFLUX_TIMEOUT", flag: "influx-timeout", usage: "influxdb HTTP timeout in seconds", ptr: &c.Influx.Timeout},
+		{key: "influx.database", env: "InfluxDB", flag: "influx-db", usage: "influxdb 1.x database", ptr: &c.Influx.Database},
+		{key: "influx.retention_policy", env: "InfluxRP", flag: "influx-rp", usage: "influxdb 1.x retention policy, the database default when empty", ptr: &c.Influx.RetentionPolicy},
+		{key: "influx.username", env: "InfluxUser", flag: "influx-user", usage: "influxdb 1.x user", ptr: &c.Influx.Username},
+		{key: "influx.password", env: "InfluxPwd", flag: "influx-password", usage: "influxdb 1.x password", secret: true, ptr: &c.Influx.Password},
+		{key: "influx.org", env: "INFLUX_ORG", flag: "influx-org", usage: "influxdb 2.x organization", ptr: &c.Influx.Org},
+		{key: "influx.bucket", env: "INFLUX_BUCKET", flag: "influx-bucket", usage: "influxdb 2.x bucket", ptr: &c.Influx.Bucket},
+		{key: "influx.token", env: "INFLUX_TOKEN", flag: "influx-token", usage: "influxdb 2.x API token", secret: true, ptr: &c.Influx.Token},
+		{key: "prometheus.ttl", env: "PROMETHEUS_TTL", flag: "prometheus-ttl", usage: "seconds a series stays on /metrics after its last update", ptr: &c.Prometheus.TTL},
+		{key: "collector.collect_interval", env: "CollectInterval", flag: "collect-interval", usage: "seconds between two collections of a node without a class", ptr: &c.Collector.CollectInterval},
+		{key: "collector.sleep", env: "Sleep", flag: "sleep", usage: "seconds between two refreshes of the connected nodes", ptr: &c.Collector.Sleep},
+		{key: "collector.workers", env: "WORKERS", flag: "workers", usage: "number of nodes collected concurrently", ptr: &c.Collector.Workers},
+		{key: "collector.queue_size", env: "QUEUE_SIZE", flag: "queue-size", usage: "number of nodes waiting for a worker", ptr: &c.Collector.QueueSize},
+		{key: "collector.node_timeout", env: "NODE_TIMEOUT", flag: "node-timeout", usage: "seconds the collection of a node may take", ptr: &c.Collector.NodeTimeout},
+		{key: "collector.container_concurrency", env: "CONTAINER_CONCURRENCY", flag: "container-concurrency", usage: "containers of a node collected in parallel", ptr: &c.Collector.ContainerConcurrency},
+		{key: "collector.container_timeout", env: "CONTAINER_TIMEOUT", flag: "container-timeout", usage: "seconds the collection of a container may take", ptr: &c.Collector.ContainerTimeout},
+		{key: "collector.stats_mode", env: "STATS_MODE", flag: "stats-mode", usage: "stream or oneshot container stats", ptr: &c.Collector.StatsMode},
+		{key: "collector.stats_cache", env: "STATS_CACHE", flag: "stats-cache", usage: "where oneshot mode caches frames, memory or redis", ptr: &c.Collector.StatsCache},
+		{key: "collector.stats_cache_ttl", env: "STATS_CACHE_TTL", flag: "stats-cache-ttl", usage: "seconds a cached stats frame is used", ptr: &c.Collector.StatsCacheTTL},
+		{key: "collector.per_core_cpu", env: "PER_CORE_CPU", flag: "per-core-cpu", usage: "emit per CPU usage samples", ptr: &c.Collector.PerCoreCpu},
+		{key: "collector.process_snapshot_threshold", env: "PROCESS_SNAPSHOT_THRESHOLD", flag: "process-snapshot-threshold", usage: "pids count from which a container's processes are recorded, 0 disables", ptr: &c.Collector.ProcessSnapshotThreshold},
+		{key: "collector.process_snapshot_limit", env: "PROCESS_SNAPSHOT_LIMIT", flag: "process-snapshot-limit", usage: "maximum processes recorded per container", ptr: &c.Collector.ProcessSnapshotLimit},
+		{key: "collector.retry_backoff", env: "RETRY_BACKOFF", flag: "retry-backoff", usage: "seconds before a failed node is retried, doubled per consecutive failure", ptr: &c.Collector.RetryBackoff},
+		{key: "collector.claim_timeout", env: "CLAIM_TIMEOUT", flag: "claim-timeout", usage: "seconds after which an unfinished claim on a node expires", ptr: &c.Collector.ClaimTimeout},
+		{key: "collector.replica_id", env: "REPLICA_ID", flag: "replica-id", usage: "id of this collector replica, hostname-pid when empty", ptr: &c.Collector.ReplicaId},
+		{key: "collector.lease_ttl", env: "LEASE_TTL", flag: "lease-ttl", usage: "seconds a node lease outlives its last renewal", ptr: &c.Collector.LeaseTTL},
+		{key: "collector.shutdown_timeout", env: "SHUTDOWN_TIMEOUT", flag: "shutdown-timeout", usage: "seconds in-flight collections are given to finish on shutdown", ptr: &c.Collector.ShutdownTimeout},
+		{key: "collector.events", env: "EVENTS", flag: "events", usage: "record docker container events of every connected node", ptr: &c.Collector.Events},
+		{key: "collector.event_actions", env: "EVENT_ACTIONS", flag: "event-actions", usage: "comma separated container event actions recorded", ptr: &c.Collector.EventActions},
+		{key: "collector.self_metrics", env: "SELF_METRICS", flag: "self-metrics", usage: "write the collector's own stage counters to the sinks", ptr: &c.Collector.SelfMetrics},
+		{key: "containers.include", env: "CONTAINER_INCLUDE", flag: "container-include", usage: "comma separated label selectors containers must all match", ptr: &c.Containers.Include},
+		{key: "containers.exclude", env: "CONTAINER_EXCLUDE", flag: "container-exclude", usage: "comma separated label selectors excluding containers", ptr: &c.Containers.Exclude},
+		{key: "containers.label_tags", env: "LABEL_TAGS", flag: "label-tags", usage: "comma separated label=tag pairs promoting container labels to tags, added to the defaults; label= drops a label", ptr: &c.Containers.LabelTags},
+		{key: "agent.node_id", env: "AGENT_NODE_ID", flag: "agent-node-id", usage: "node id of the local node in agent mode", ptr: &c.Agent.NodeId},
+		{key: "agent.cgroup_root", env: "CGROUP_ROOT", flag: "cgroup-root", usage: "cgroup filesystem root in agent mode", ptr: &c.Agent.CgroupRoot},
+		{key: "agent.proc_root", env: "PROC_ROOT", flag: "proc-root", usage: "proc filesystem root in agent mode", ptr: &c.Agent.ProcRoot},
+		{key: "agent.docker_root", env: "DOCKER_ROOT", flag: "docker-root", usage: "docker data root in agent mode", ptr: &c.Agent.DockerRoot},
+		{key: "agent.interval", env: "AGENT_INTERVAL", flag: "agent-interval", usage: "seconds between two collections in agent mode", ptr: &c.Agent.Interval},
+		{key: "ingest.secret", env: "INGEST_SECRET", flag: "ingest-secret", usage: "secret node ingest tokens derive from, /ingest is disabled when empty", secret: true, ptr: &c.Ingest.Secret},
+		{key: "ingest.max_body_size", env: "INGEST_MAX_BODY_SIZE", flag: "ingest-max-body-size", usage: "maximum ingest request body in bytes", ptr: &c.Ingest.MaxBodySize},
+		{key: "ingest.measurements", env: "INGEST_MEASUREMENTS", flag: "ingest-measurements", usage: "comma separated measurement prefixes nodes may push", ptr: &c.Ingest.Measurements},
+		{key: "push.addr", env: "PUSH_ADDR", flag: "push-addr", usage: "collector URL the push sink sends to", ptr: &c.Push.Addr},
+		{key: "push.token", env: "PUSH_TOKEN", flag: "push-token", usage: "ingest token of the local node", secret: true, ptr: &c.Push.Token},
+		{key: "push.timeout", env: "PUSH_TIMEOUT", flag: "push-timeout", usage: "push HTTP timeout in seconds", ptr: &c.Push.Timeout},
+	}
+}
+
+// loadConfig fills conf from the config file, the environment and the
+// command line. It reports whether the effective config should be dumped
+// instead of running the collector.
+func loadConfig(args []string) (bool, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("METRICS_CONFIG"), "path of the YAML config file")
+	dump := fs.Bool("dump-config", false, "print the effective config and exit")
+	flags := make(map[string]string)
+	for _, s := range c.settings() {
+		_, isBool := s.ptr.(*bool)
+		fs.Var(rawValue{name: s.flag, values: flags, isBool: isBool}, s.flag, s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+
+	if *path != "" {
+		data, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return *dump, err
+		}
+		if err = yaml.UnmarshalStrict(data, &c); err != nil {
+			return *dump, fmt.Errorf("parse %s: %v", *path, err)
+		}
+	}
+	for _, s := range c.settings() {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := setValue(s.ptr, v); err != nil {
+				return *dump, fmt.Errorf("env %s: %v", s.env, err)
+			}
+		}
+	}
+	for _, s := range c.settings() {
+		if v, ok := flags[s.flag]; ok {
+			if err := setValue(s.ptr, v); err != nil {
+				return *dump, fmt.Errorf("flag -%s: %v", s.flag, err)
+			}
+		}
+	}
+	if c.Collector.ReplicaId == "" {
+		host, _ := os.Hostname()
+		c.Collector.ReplicaId = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	conf = c
+	return *dump, c.validate()
+}
+
+func (c *Config) validate() error {
+	var errs []string
+	for _, s := range c.settings() {
+		// The agent reads the local node only and needs neither mysql
+		// nor redis.
+		if s.required && c.Mode != "agent" && isZero(s.ptr) {
+			errs = append(errs, fmt.Sprintf("%s is required (config key %s, env %s or flag -%s)", s.key, s.key, s.env, s.flag))
+		}
+	}
+	switch c.Mode {
+	case "collector":
+	case "agent":
+		if c.Agent.NodeId == "" {
+			errs = append(errs, "agent.node_id is required in agent mode")
+		}
+		if c.Agent.Interval <= 0 {
+			errs = append(errs, "agent.interval must be positive")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("mode %q must be collector or agent", c.Mode))
+	}
+	if len(c.Sinks) == 0 {
+		errs = append(errs, "sinks must list at least one sink")
+	}
+	for _, name := range c.Sinks {
+		if _, ok := sinkFactories[name]; !ok {
+			errs = append(errs, fmt.Sprintf("unknown sink %q (available: %s)", name, strings.Join(sinkNames(), ", ")))
+		}
+	}
+	if c.hasSink("influx") {
+		errs = append(errs, c.Influx.validate()...)
+	}
+	if c.hasSink("push") {
+		if c.Push.Addr == "" || c.Push.Token == "" {
+			errs = append(errs, "push.addr and push.token are required by the push sink")
+		}
+		if c.Agent.NodeId == "" {
+			errs = append(errs, "agent.node_id is required by the push sink")
+		}
+		if c.Push.Timeout <= 0 {
+			errs = append(errs, "push.timeout must be positive")
+		}
+	}
+	if c.Ingest.Secret != "" {
+		if c.Ingest.MaxBodySize <= 0 {
+			errs = append(errs, "ingest.max_body_size must be positive")
+		}
+		if len(c.Ingest.Measurements) == 0 {
+			errs = append(errs, "ingest.measurements must list at least one prefix")
+		}
+	}
+	if c.Prometheus.TTL < 0 {
+		errs = append(errs, "prometheus.ttl must not be negative")
+	}
+	if c.Collector.CollectInterval <= 0 {
+		errs = append(errs, "collector.collect_interval must be positive")
+	}
+	for name, class := range c.Collector.Classes {
+		if class.Interval <= 0 {
+			errs = append(errs, fmt.Sprintf("collector.classes.%s.interval must be positive", name))
+		}
+	}
+	if c.Collector.Sleep <= 0 {
+		errs = append(errs, "collector.sleep must be positive")
+	}
+	if c.Collector.Workers <= 0 {
+		errs = append(errs, "collector.workers must be positive")
+	}
+	if c.Collector.QueueSize <= 0 {
+		errs = append(errs, "collector.queue_size must be positive")
+	}
+	if c.Collector.NodeTimeout <= 0 {
+		errs = append(errs, "collector.node_timeout must be positive")
+	}
+	if c.Collector.ContainerConcurrency <= 0 {
+		errs = append(errs, "collector.container_concurrency must be positive")
+	}
+	if c.Collector.ContainerTimeout <= 0 {
+		errs = append(errs, "collector.container_timeout must be positive")
+	}
+	if c.Collector.StatsMode != "stream" && c.Collector.StatsMode != "oneshot" {
+		errs = append(errs, fmt.Sprintf("collector.stats_mode %q must be stream or oneshot", c.Collector.StatsMode))
+	}
+	if c.Collector.StatsCache != "memory" && c.Collector.StatsCache != "redis" {
+		errs = append(errs, fmt.Sprintf("collector.stats_cache %q must be memory or redis", c.Collector.StatsCache))
+	}
+	if c.Collector.StatsCacheTTL < 0 {
+		errs = append(errs, "collector.stats_cache_ttl must not be negative")
+	}
+	if c.Collector.ProcessSnapshotLimit <= 0 {
+		errs = append(errs, "collector.process_snapshot_limit must be positive")
+	}
+	if c.Collector.RetryBackoff <= 0 {
+		errs = append(errs, "collector.retry_backoff must be positive")
+	}
+	if c.Collector.ClaimTimeout <= 0 {
+		errs = append(errs, "collector.claim_timeout must be positive")
+	}
+	if c.Collector.LeaseTTL <= 0 {
+		errs = append(errs, "collector.lease_ttl must be positive")
+	}
+	if c.Collector.ShutdownTimeout < 0 {
+		errs = append(errs, "collector.shutdown_timeout must not be negative")
+	}
+	if c.Collector.Events && len(c.Collector.EventActions) == 0 {
+		errs = append(errs, "collector.event_actions must list at least one action when events are enabled")
+	}
+	if _, err := newContainerFilter(c.Containers); err != nil {
+		errs = append(errs, "containers: "+err.Error())
+	}
+	for label, tag := range c.Containers.LabelTags {
+		switch tag {
+		case "", "container_name", "container_id", "node_id", "action":
+			errs = append(errs, fmt.Sprintf("containers.label_tags: label %s cannot be written as tag %q", label, tag))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (c *InfluxConfig) validate() []string {
+	var errs []string
+	if c.Addr == "" {
+		errs = append(errs, "influx.addr is required by the influx sink (config key influx.addr, env InfluxAddr or flag -influx-addr)")
+	}
+	if _, ok := v1Precision[c.Precision]; !ok {
+		errs = append(errs, fmt.Sprintf("influx.precision %q must be one of ns, us, ms, s", c.Precision))
+	}
+	switch c.Version {
+	case 1:
+		if c.Database == "" {
+			errs = append(errs, "influx.database is required by influxdb 1.x (config key influx.database, env InfluxDB or flag -influx-db)")
+		}
+	case 2:
+		if c.Org == "" || c.Bucket == "" || c.Token == "" {
+			errs = append(errs, "influx.org, influx.bucket and influx.token are required by influxdb 2.x")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("influx.version %d must be 1 or 2", c.Version))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, "influx.timeout must be positive")
+	}
+	return errs
+}
+
+func (c *Config) hasSink(name string) bool {
+	for _, s := range c.Sinks {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dump writes the effective config as YAML with secrets masked.
+func (c Config) dump(w io.Writer) error {
+	for _, s := range c.settings() {
+		if p, ok := s.ptr.(*string); ok && s.secret && *p != "" {
+			*p = maskSecret(*p)
+		}
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+var dsnPassword = regexp.MustCompile(`^([^:@/]*):[^@]*@`)
+
+// maskSecret hides a password, keeping the user part of a mysql DSN so the
+// dump still shows which account is used.
+func maskSecret(v string) string {
+	if dsnPassword.MatchString(v) {
+		return dsnPassword.ReplaceAllString(v, "$1:***@")
+	}
+	return "***"
+}
+
+// rawValue records a flag value so it can be applied after the config
+// file and the environment.
+type rawValue struct {
+	name   string
+	values map[string]string
+	isBool bool
+}
+
+func (v rawValue) String() string {
+	if v.values == nil {
+		return ""
+	}
+	return v.values[v.name]
+}
+
+func (v rawValue) Set(s string) error {
+	v.values[v.name] = s
+	return nil
+}
+
+func (v rawValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+func setValue(ptr interface{}, v string) error {
+	switch p := ptr.(type) {
+	case *string:
+		*p = v
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*p = b
+	case *int:
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*p = i
+	case *int64:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		*p = i
+	case *uint64:
+		i, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		*p = i
+	case *map[string]string:
+		// Pairs are merged into the map like a config file does, an empty
+		// value removes the key.
+		if *p == nil {
+			*p = make(map[string]string)
+		}
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%q is not a key=value pair", item)
+			}
+			if kv[1] == "" {
+				delete(*p, kv[0])
+				continue
+			}
+			(*p)[kv[0]] = kv[1]
+		}
+	case *[]string:
+		*p = nil
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %T", ptr)
+	}
+	return nil
+}
+
+func isZero(ptr interface{}) bool {
+	switch p := ptr.(type) {
+	case *string:
+		return *p == ""
+	case *int:
+		return *p == 0
+	case *int64:
+		return *p == 0
+	case *[]string:
+		return len(*p) == 0
+	}
+	return false
+}
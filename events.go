@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"golang.org/x/net/context"
+	"gopkg.in/redis.v5"
+)
+
+// eventWatchers keeps one docker events subscription per connected node.
+// A subscription holds a lease so that a node's events are recorded by a
+// single replica, and resumes from the last recorded event after the
+// tunnel drops or the lease moves to another replica.
+type eventWatchers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	watchers map[string]context.CancelFunc
+}
+
+func newEventWatchers() *eventWatchers {
+	w := &eventWatchers{watchers: make(map[string]context.CancelFunc)}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return w
+}
+
+// Sync starts watching the nodes of ids not watched yet and stops watching
+// the nodes no longer in ids.
+func (w *eventWatchers) Sync(ids []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ctx.Err() != nil {
+		return
+	}
+	keep := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+		if _, ok := w.watchers[id]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(w.ctx)
+		w.watchers[id] = cancel
+		w.wg.Add(1)
+		go func(id string) {
+			defer w.wg.Done()
+			watchNodeEvents(ctx, id)
+		}(id)
+	}
+	for id, cancel := range w.watchers {
+		if !keep[id] {
+			cancel()
+			delete(w.watchers, id)
+		}
+	}
+}
+
+// Stop cancels every subscription and waits for them to release their
+// leases.
+func (w *eventWatchers) Stop() {
+	w.mu.Lock()
+	w.cancel()
+	w.watchers = make(map[string]context.CancelFunc)
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+// watchNodeEvents subscribes to the events of node id until ctx is done.
+// Failed subscriptions are retried with the same backoff as failed
+// collections.
+func watchNodeEvents(ctx context.Context, id string) {
+	base := time.Duration(conf.Collector.RetryBackoff) * time.Second
+	max := time.Duration(conf.Collector.CollectInterval) * time.Second
+	backoff := base
+	for {
+		wait := time.Duration(conf.Collector.LeaseTTL) * time.Second
+		lease, isok, err := acquireLease(ctx, fmt.Sprintf("metrics.events.lease.%s", id))
+		if err != nil {
+			log.Printf("acquire events lease(%s) failed!err:=%v", id, err)
+		} else if isok {
+			start := time.Now()
+			err = streamNodeEvents(lease.ctx, id)
+			lease.Release()
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("events of node(%s) interrupted!err:=%v", id, err)
+			if time.Since(start) > max {
+				backoff = base
+			}
+			wait = backoff
+			if backoff *= 2; backoff > max {
+				backoff = max
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func streamNodeEvents(ctx context.Context, id string) error {
+	url, err := nodeDockerUrl(id)
+	if err != nil {
+		return err
+	}
+	nctx, ncancel := context.WithTimeout(ctx, time.Duration(conf.Collector.NodeTimeout)*time.Second)
+	cli, _, err := newClient(nctx, url)
+	ncancel()
+	if err != nil {
+		return fmt.Errorf("new docker client(%s) failed!err:=%v", url, err)
+	}
+	defer cli.Close()
+
+	since, err := loadEventsSince(id)
+	if err != nil {
+		log.Printf("load events since(%s) failed!err:=%v", id, err)
+	}
+	if since == "" {
+		since = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	args := filters.NewArgs()
+	args.Add("type", "container")
+	msgs, errs := cli.Events(ctx, types.EventsOptions{Since: since, Filters: args})
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case m := <-msgs:
+			s, ok := eventSample(id, m)
+			if !ok {
+				continue
+			}
+			wctx, wcancel := context.WithTimeout(context.Background(), time.Second*10)
+			err := metricSink.Write(wctx, []Sample{s})
+			wcancel()
+			if err != nil {
+				log.Printf("write event(%s,%s) failed!err:=%v", id, s.Tags["action"], err)
+				continue
+			}
+			if err = saveEventsSince(id, s.Time); err != nil {
+				log.Printf("save events since(%s) failed!err:=%v", id, err)
+			}
+		}
+	}
+}
+
+// eventSample converts a container event into a docker_container_event
+// sample. It reports false for actions that are not recorded and for
+// containers the label filter does not select.
+func eventSample(nodeId string, m events.Message) (Sample, bool) {
+	// Engines before API 1.22 only fill the deprecated fields.
+	action, cid := m.Action, m.Actor.ID
+	if action == "" {
+		action = m.Status
+	}
+	if cid == "" {
+		cid = m.ID
+	}
+	// health_status events carry the new status, as in
+	// "health_status: unhealthy".
+	status := ""
+	if i := strings.Index(action, ":"); i >= 0 {
+		status = strings.TrimSpace(action[i+1:])
+		action = action[:i]
+	}
+	if !recordedAction(action) {
+		return Sample{}, false
+	}
+	attrs := m.Actor.Attributes
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	// Attributes hold the container labels besides name, image and the
+	// action specific values.
+	if !containerSelector.Match(attrs) {
+		return Sample{}, false
+	}
+
+	tags := labelTags(attrs)
+	tags["container_name"] = attrs["name"]
+	tags["container_id"] = cid
+	tags["node_id"] = nodeId
+	tags["action"] = action
+	fields := map[string]interface{}{
+		"image": attrs["image"],
+	}
+	if m.From != "" {
+		fields["image"] = m.From
+	}
+	if status != "" {
+		fields["status"] = status
+	}
+	if code, err := strconv.Atoi(attrs["exitCode"]); err == nil {
+		fields["exit_code"] = code
+	}
+	if sig := attrs["signal"]; sig != "" {
+		fields["signal"] = sig
+	}
+	s := newSample("docker_container_event", tags, fields)
+	if m.TimeNano > 0 {
+		s.Time = time.Unix(0, m.TimeNano)
+	} else if m.Time > 0 {
+		s.Time = time.Unix(m.Time, 0)
+	}
+	return s, true
+}
+
+func recordedAction(action string) bool {
+	for _, a := range conf.Collector.EventActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// The time of the last recorded event is kept in Redis so any replica can
+// resume the subscription of a node. The engine sends events at since
+// again, which are written with the same time and tags and so overwrite
+// the first copy.
+func loadEventsSince(id string) (string, error) {
+	v, err := redisCli.Get(fmt.Sprintf("metrics.events.since.%s", id)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return v, err
+}
+
+func saveEventsSince(id string, t time.Time) error {
+	v := fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+	return redisCli.Set(fmt.Sprintf("metrics.events.since.%s", id), v, 24*time.Hour).Err()
+}
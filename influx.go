@@ -1,73 +1,163 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
-	"os"
+	"strings"
 	"time"
 
-	"github.com/influxdb/influxdb/client"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 )
 
-var influxCli *client.Client
+func init() {
+	registerSink("influx", func(cfg Config) (Sink, error) {
+		return newInfluxSink(cfg.Influx, nil)
+	})
+}
 
-const (
-	InfluxUser = "root"
-	InfluxPwd  = "root"
-)
+// v1Precision maps 2.x precision names to the ones of the 1.x API.
+var v1Precision = map[string]string{"ns": "n", "us": "u", "ms": "ms", "s": "s"}
 
-var InfluxDb string
+// influxSink writes samples as line protocol to the HTTP write endpoint of
+// InfluxDB 1.x (/write) or 2.x (/api/v2/write).
+type influxSink struct {
+	client   *http.Client
+	addr     string
+	writeURL string
+	token    string
+	username string
+	password string
+	gzip     bool
+	divisor  int64
+}
 
-func InitInflux() {
-	InfluxAddr := os.Getenv("InfluxAddr")
-	if InfluxAddr == "" {
-		InfluxAddr = "http://192.168.1.28:8086"
+// newInfluxSink builds a sink for cfg and pings the server. A nil client
+// uses a default client with cfg.Timeout.
+func newInfluxSink(cfg InfluxConfig, client *http.Client) (*influxSink, error) {
+	if client == nil {
+		client = &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second}
 	}
-	InfluxDb = os.Getenv("InfluxDB")
-	if InfluxDb == "" {
-		InfluxDb = "daosr"
+	divisor, err := precisionDivisor(cfg.Precision)
+	if err != nil {
+		return nil, err
 	}
-	u, err := url.Parse(InfluxAddr)
+	u, err := url.Parse(strings.TrimRight(cfg.Addr, "/"))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	conf := client.Config{
-		URL:      *u,
-		Username: InfluxUser,
-		Password: InfluxPwd,
+	s := &influxSink{
+		client:  client,
+		addr:    u.String(),
+		gzip:    cfg.Gzip,
+		divisor: divisor,
+	}
+	q := url.Values{}
+	switch cfg.Version {
+	case 1:
+		u.Path += "/write"
+		q.Set("db", cfg.Database)
+		if cfg.RetentionPolicy != "" {
+			q.Set("rp", cfg.RetentionPolicy)
+		}
+		q.Set("precision", v1Precision[cfg.Precision])
+		s.username = cfg.Username
+		s.password = cfg.Password
+	case 2:
+		u.Path += "/api/v2/write"
+		q.Set("org", cfg.Org)
+		q.Set("bucket", cfg.Bucket)
+		q.Set("precision", cfg.Precision)
+		s.token = cfg.Token
+	default:
+		return nil, fmt.Errorf("unsupported influx version %d", cfg.Version)
 	}
+	u.RawQuery = q.Encode()
+	s.writeURL = u.String()
 
-	influxCli, err = client.NewClient(conf)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	ver, err := s.ping(ctx)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	log.Printf("ping influx success! %v, %s", time.Since(start), ver)
+	return s, nil
+}
 
-	dur, ver, err := influxCli.Ping()
+func (s *influxSink) ping(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("GET", s.addr+"/ping", nil)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	log.Printf("ping influx success! %v, %s", dur, ver)
-
+	resp, err := ctxhttp.Do(ctx, s.client, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("ping %s: %s", s.addr, resp.Status)
+	}
+	return resp.Header.Get("X-Influxdb-Version"), nil
 }
-func writePoints(pts []client.Point) error {
-	bps := client.BatchPoints{
-		Points:          pts,
-		Database:        InfluxDb,
-		RetentionPolicy: "default",
+
+func (s *influxSink) Write(ctx context.Context, samples []Sample) error {
+	var buf bytes.Buffer
+	for _, sample := range samples {
+		if err := appendLine(&buf, sample, s.divisor); err != nil {
+			return err
+		}
 	}
-	_, err := influxCli.Write(bps)
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	var body io.Reader = &buf
+	if s.gzip {
+		var zbuf bytes.Buffer
+		zw := gzip.NewWriter(&zbuf)
+		if _, err := buf.WriteTo(zw); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = &zbuf
+	}
+	req, err := http.NewRequest("POST", s.writeURL, body)
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := ctxhttp.Do(ctx, s.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
 	return nil
 }
 
-func newPoints(measurement string, tags map[string]string, fields map[string]interface{}) client.Point {
-	pt := client.Point{Name: measurement,
-		Tags:      tags,
-		Fields:    fields,
-		Time:      time.Now(),
-		Precision: "n"}
-	return pt
+func (s *influxSink) Close() error {
+	return nil
 }
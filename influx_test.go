@@ -0,0 +1,192 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// influxStub stands in for an InfluxDB server and records the last write.
+type influxStub struct {
+	status   int
+	path     string
+	query    map[string]string
+	auth     string
+	user     string
+	password string
+	encoding string
+	body     string
+}
+
+func (s *influxStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ping" {
+		w.Header().Set("X-Influxdb-Version", "stub")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	s.path = r.URL.Path
+	s.query = make(map[string]string)
+	for k, v := range r.URL.Query() {
+		s.query[k] = v[0]
+	}
+	s.auth = r.Header.Get("Authorization")
+	s.user, s.password, _ = r.BasicAuth()
+	s.encoding = r.Header.Get("Content-Encoding")
+	var body io.Reader = r.Body
+	if s.encoding == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	data, _ := ioutil.ReadAll(body)
+	s.body = string(data)
+	if s.status != 0 {
+		http.Error(w, `{"error":"field type conflict"}`, s.status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func testSamples() []Sample {
+	return []Sample{{
+		Measurement: "docker_container_mem",
+		Tags:        map[string]string{"container_name": "web"},
+		Fields:      map[string]interface{}{"usage": int64(10)},
+		Time:        time.Unix(1500000000, 0),
+	}}
+}
+
+func TestInfluxSinkWrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       InfluxConfig
+		path      string
+		query     map[string]string
+		auth      string
+		user      string
+		encoding  string
+		timestamp string
+	}{
+		{
+			name:      "v1",
+			cfg:       InfluxConfig{Version: 1, Precision: "s", Database: "daosr", RetentionPolicy: "week", Username: "u", Password: "p"},
+			path:      "/write",
+			query:     map[string]string{"db": "daosr", "rp": "week", "precision": "s"},
+			user:      "u",
+			timestamp: "1500000000",
+		},
+		{
+			name:      "v1 without rp",
+			cfg:       InfluxConfig{Version: 1, Precision: "ns", Database: "daosr"},
+			path:      "/write",
+			query:     map[string]string{"db": "daosr", "precision": "n"},
+			timestamp: "1500000000000000000",
+		},
+		{
+			name:      "v2 gzip",
+			cfg:       InfluxConfig{Version: 2, Precision: "ms", Org: "dao", Bucket: "metrics", Token: "secret", Gzip: true},
+			path:      "/api/v2/write",
+			query:     map[string]string{"org": "dao", "bucket": "metrics", "precision": "ms"},
+			auth:      "Token secret",
+			encoding:  "gzip",
+			timestamp: "1500000000000",
+		},
+	}
+	for _, tt := range tests {
+		stub := &influxStub{}
+		srv := httptest.NewServer(stub)
+		tt.cfg.Addr = srv.URL + "/"
+		sink, err := newInfluxSink(tt.cfg, nil)
+		if err != nil {
+			srv.Close()
+			t.Errorf("%s: newInfluxSink: %v", tt.name, err)
+			continue
+		}
+		err = sink.Write(context.Background(), testSamples())
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: Write: %v", tt.name, err)
+			continue
+		}
+		if stub.path != tt.path {
+			t.Errorf("%s: path %q, want %q", tt.name, stub.path, tt.path)
+		}
+		if len(stub.query) != len(tt.query) {
+			t.Errorf("%s: query %v, want %v", tt.name, stub.query, tt.query)
+		}
+		for k, v := range tt.query {
+			if stub.query[k] != v {
+				t.Errorf("%s: query %s=%q, want %q", tt.name, k, stub.query[k], v)
+			}
+		}
+		if tt.user == "" && stub.auth != tt.auth {
+			t.Errorf("%s: Authorization %q, want %q", tt.name, stub.auth, tt.auth)
+		}
+		if stub.user != tt.user || (tt.user != "" && stub.password != tt.cfg.Password) {
+			t.Errorf("%s: basic auth %q:%q, want %q:%q", tt.name, stub.user, stub.password, tt.user, tt.cfg.Password)
+		}
+		if stub.encoding != tt.encoding {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.name, stub.encoding, tt.encoding)
+		}
+		want := "docker_container_mem,container_name=web usage=10i " + tt.timestamp + "\n"
+		if stub.body != want {
+			t.Errorf("%s: body %q, want %q", tt.name, stub.body, want)
+		}
+	}
+}
+
+func TestInfluxSinkWriteError(t *testing.T) {
+	stub := &influxStub{status: http.StatusBadRequest}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	sink, err := newInfluxSink(InfluxConfig{Addr: srv.URL, Version: 1, Precision: "ns", Database: "daosr"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Write(context.Background(), testSamples())
+	if err == nil {
+		t.Fatal("expected an error for a 400 response")
+	}
+	if !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "field type conflict") {
+		t.Errorf("error %q lacks the status or the server message", err)
+	}
+}
+
+func TestInfluxSinkEmptyWrite(t *testing.T) {
+	stub := &influxStub{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	sink, err := newInfluxSink(InfluxConfig{Addr: srv.URL, Version: 1, Precision: "ns", Database: "daosr"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if stub.path != "" {
+		t.Errorf("empty batch was posted to %s", stub.path)
+	}
+}
+
+func TestNewInfluxSinkPingFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	if _, err := newInfluxSink(InfluxConfig{Addr: srv.URL, Version: 1, Precision: "ns"}, nil); err == nil {
+		t.Error("expected an error when the ping fails")
+	}
+	if _, err := newInfluxSink(InfluxConfig{Addr: srv.URL, Version: 3, Precision: "ns"}, nil); err == nil {
+		t.Error("expected an error for an unknown version")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// InitIngest serves POST /ingest when an ingest secret is configured.
+func InitIngest(cfg IngestConfig) {
+	if cfg.Secret == "" {
+		return
+	}
+	http.Handle("/ingest", &ingestHandler{cfg: cfg})
+}
+
+// ingestToken is the token node nodeId authenticates with, the hex
+// HMAC-SHA256 of the node id keyed with the ingest secret.
+func ingestToken(secret string, nodeId string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nodeId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ingestHandler accepts samples pushed by nodes that cannot be pulled.
+// A request carries the node id in X-Node-Id and its token as a bearer
+// token. The body is a JSON array of samples or line protocol, optionally
+// gzipped; line protocol timestamps are in the unit of the precision
+// query parameter, ns by default.
+type ingestHandler struct {
+	cfg IngestConfig
+}
+
+// ingestSample is the JSON form of a sample. Numbers are written as
+// floats, JSON cannot tell 12 from 12.0, except for the fields listed in
+// Integers; a field must keep its type across writes for InfluxDB to
+// accept it. Time is a RFC 3339 string or Unix nanoseconds, the time of
+// receipt when missing.
+type ingestSample struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Integers    []string               `json:"integers"`
+	Time        json.RawMessage        `json:"time"`
+}
+
+func (h *ingestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nodeId := r.Header.Get("X-Node-Id")
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if nodeId == "" || !hmac.Equal([]byte(token), []byte(ingestToken(h.cfg.Secret, nodeId))) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, h.cfg.MaxBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		// Bound the decompressed size as well.
+		body = io.LimitReader(zr, h.cfg.MaxBodySize+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > h.cfg.MaxBodySize {
+		http.Error(w, fmt.Sprintf("body exceeds %d bytes", h.cfg.MaxBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	now := time.Now()
+	var samples []Sample
+	if strings.Contains(r.Header.Get("Content-Type"), "json") {
+		samples, err = decodeIngestJSON(data, now)
+	} else {
+		var divisor int64
+		divisor, err = precisionDivisor(r.URL.Query().Get("precision"))
+		if err == nil {
+			samples, err = parseLines(data, divisor, now)
+		}
+	}
+	if err == nil {
+		err = h.validate(samples)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range samples {
+		samples[i].Tags["node_id"] = nodeId
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err = metricSink.Write(ctx, samples); err != nil {
+		log.Printf("write ingested points (%d,%s) failed!err:=%v", len(samples), nodeId, err)
+		http.Error(w, "write failed", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeIngestJSON(data []byte, now time.Time) ([]Sample, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Keep integers exact.
+	decoder.UseNumber()
+	var in []ingestSample
+	if err := decoder.Decode(&in); err != nil {
+		return nil, err
+	}
+	samples := make([]Sample, 0, len(in))
+	for i, is := range in {
+		s := Sample{
+			Measurement: is.Measurement,
+			Tags:        is.Tags,
+			Fields:      make(map[string]interface{}, len(is.Fields)),
+			Time:        now,
+		}
+		if s.Tags == nil {
+			s.Tags = make(map[string]string)
+		}
+		integers := make(map[string]bool, len(is.Integers))
+		for _, k := range is.Integers {
+			integers[k] = true
+		}
+		for k, v := range is.Fields {
+			switch v := v.(type) {
+			case json.Number:
+				if integers[k] {
+					n, err := v.Int64()
+					if err != nil {
+						return nil, fmt.Errorf("sample %d: field %s: %v", i, k, err)
+					}
+					s.Fields[k] = n
+				} else if f, err := v.Float64(); err == nil {
+					s.Fields[k] = f
+				} else {
+					return nil, fmt.Errorf("sample %d: field %s: %v", i, k, err)
+				}
+			case string, bool:
+				s.Fields[k] = v
+			default:
+				return nil, fmt.Errorf("sample %d: field %s: unsupported value %T", i, k, v)
+			}
+		}
+		if len(is.Time) > 0 && string(is.Time) != "null" {
+			var ns int64
+			var ts time.Time
+			if err := json.Unmarshal(is.Time, &ns); err == nil {
+				s.Time = time.Unix(0, ns)
+			} else if err := json.Unmarshal(is.Time, &ts); err == nil {
+				s.Time = ts
+			} else {
+				return nil, fmt.Errorf("sample %d: invalid time %s", i, is.Time)
+			}
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// validate rejects the batch if a sample has no fields or a measurement
+// nodes may not write.
+func (h *ingestHandler) validate(samples []Sample) error {
+	for i, s := range samples {
+		allowed := false
+		for _, prefix := range h.cfg.Measurements {
+			if strings.HasPrefix(s.Measurement, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("sample %d: measurement %q is not accepted", i, s.Measurement)
+		}
+		if len(s.Fields) == 0 {
+			return fmt.Errorf("sample %d: no fields", i)
+		}
+		for k := range s.Tags {
+			if k == "" {
+				return fmt.Errorf("sample %d: empty tag key", i)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// captureSink records the samples written to it.
+type captureSink struct {
+	samples []Sample
+}
+
+func (s *captureSink) Write(ctx context.Context, samples []Sample) error {
+	s.samples = append(s.samples, samples...)
+	return nil
+}
+
+func (s *captureSink) Close() error {
+	return nil
+}
+
+// withCaptureSink replaces metricSink until the returned func is called.
+func withCaptureSink() (*captureSink, func()) {
+	saved := metricSink
+	sink := &captureSink{}
+	metricSink = sink
+	return sink, func() { metricSink = saved }
+}
+
+var testIngestConfig = IngestConfig{Secret: "s3cret", MaxBodySize: 1024, Measurements: []string{"docker_"}}
+
+func ingestRequest(nodeId string, token string, body []byte, gzipped bool) *http.Request {
+	if gzipped {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+	r := httptest.NewRequest("POST", "/ingest", bytes.NewReader(body))
+	r.Header.Set("X-Node-Id", nodeId)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if gzipped {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	return r
+}
+
+func TestIngestHandler(t *testing.T) {
+	token := ingestToken(testIngestConfig.Secret, "n1")
+	line := []byte("docker_container_mem,container_name=web usage=1i 1500000000000000000\n")
+	big := bytes.Repeat([]byte("docker_container_mem usage=1i\n"), 100)
+	tests := []struct {
+		name    string
+		req     *http.Request
+		status  int
+		samples int
+	}{
+		{name: "plain", req: ingestRequest("n1", token, line, false), status: http.StatusNoContent, samples: 1},
+		{name: "gzip", req: ingestRequest("n1", token, line, true), status: http.StatusNoContent, samples: 1},
+		{name: "bad token", req: ingestRequest("n1", ingestToken("other", "n1"), line, false), status: http.StatusUnauthorized},
+		{name: "token of another node", req: ingestRequest("n2", token, line, false), status: http.StatusUnauthorized},
+		{name: "no node id", req: ingestRequest("", token, line, false), status: http.StatusUnauthorized},
+		{name: "get", req: httptest.NewRequest("GET", "/ingest", nil), status: http.StatusMethodNotAllowed},
+		{name: "too large", req: ingestRequest("n1", token, big, false), status: http.StatusBadRequest},
+		{name: "too large gzipped", req: ingestRequest("n1", token, big, true), status: http.StatusRequestEntityTooLarge},
+		{name: "bad gzip", req: func() *http.Request {
+			r := ingestRequest("n1", token, line, false)
+			r.Header.Set("Content-Encoding", "gzip")
+			return r
+		}(), status: http.StatusBadRequest},
+		{name: "measurement not accepted", req: ingestRequest("n1", token, []byte("collector_self count=1i\n"), false), status: http.StatusBadRequest},
+		{name: "invalid line", req: ingestRequest("n1", token, []byte("docker_container_mem usage\n"), false), status: http.StatusBadRequest},
+	}
+	h := &ingestHandler{cfg: testIngestConfig}
+	for _, tt := range tests {
+		sink, restore := withCaptureSink()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, tt.req)
+		restore()
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, strings.TrimSpace(w.Body.String()))
+		}
+		if len(sink.samples) != tt.samples {
+			t.Errorf("%s: %d samples written, want %d", tt.name, len(sink.samples), tt.samples)
+		}
+		for _, s := range sink.samples {
+			if s.Tags["node_id"] != "n1" {
+				t.Errorf("%s: node_id tag %q, want the authenticated node", tt.name, s.Tags["node_id"])
+			}
+		}
+	}
+}
+
+func TestIngestHandlerJSON(t *testing.T) {
+	token := ingestToken(testIngestConfig.Secret, "n1")
+	body := []byte(`[{"measurement":"docker_container_mem","tags":{"node_id":"spoofed"},"fields":{"usage_percent":0,"usage":12},"integers":["usage"],"time":1500000000000000000}]`)
+	r := ingestRequest("n1", token, body, false)
+	r.Header.Set("Content-Type", "application/json")
+	sink, restore := withCaptureSink()
+	defer restore()
+	w := httptest.NewRecorder()
+	(&ingestHandler{cfg: testIngestConfig}).ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	want := []Sample{{
+		Measurement: "docker_container_mem",
+		Tags:        map[string]string{"node_id": "n1"},
+		Fields:      map[string]interface{}{"usage_percent": 0.0, "usage": int64(12)},
+		Time:        time.Unix(0, 1500000000000000000),
+	}}
+	if !reflect.DeepEqual(sink.samples, want) {
+		t.Errorf("got %#v, want %#v", sink.samples, want)
+	}
+}
+
+// TestPushIngestRoundTrip pushes an agent's samples through the push sink
+// to the ingest handler.
+func TestPushIngestRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(&ingestHandler{cfg: testIngestConfig})
+	defer srv.Close()
+	push := newPushSink(PushConfig{Addr: srv.URL, Token: ingestToken(testIngestConfig.Secret, "n1"), Timeout: 10}, "n1", nil)
+
+	ts := time.Unix(1500000000, 0)
+	in := []Sample{{
+		Measurement: "docker_container_health",
+		Tags:        map[string]string{"container_name": "web", "node_id": "n1"},
+		Fields: map[string]interface{}{
+			"status":         "unhealthy",
+			"failing_streak": int64(3),
+			"output":         "line1\nline2 \"quoted\" \\ end\n",
+			"probe_duration": 0.5,
+		},
+		Time: ts,
+	}}
+	sink, restore := withCaptureSink()
+	defer restore()
+	if err := push.Write(context.Background(), in); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sink.samples, in) {
+		t.Errorf("got %#v, want %#v", sink.samples, in)
+	}
+
+	bad := newPushSink(PushConfig{Addr: srv.URL, Token: "wrong", Timeout: 10}, "n1", nil)
+	if err := bad.Write(context.Background(), in); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("push with a wrong token: %v, want a 401 error", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+)
+
+// labelSelector matches container labels. The syntax is
+//
+//	key        label exists
+//	!key       label does not exist
+//	key=value  label equals value
+//	key!=value label is missing or differs from value
+//	key=~re    label matches the regular expression
+//	key!~re    label is missing or does not match the regular expression
+type labelSelector struct {
+	key   string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func parseLabelSelector(s string) (labelSelector, error) {
+	s = strings.TrimSpace(s)
+	for _, op := range []string{"!=", "=~", "!~", "="} {
+		if i := strings.Index(s, op); i > 0 {
+			l := labelSelector{key: s[:i], op: op, value: s[i+len(op):]}
+			if op == "=~" || op == "!~" {
+				re, err := regexp.Compile("^(?:" + l.value + ")$")
+				if err != nil {
+					return l, fmt.Errorf("label selector %q: %v", s, err)
+				}
+				l.re = re
+			}
+			return l, nil
+		}
+	}
+	if strings.HasPrefix(s, "!") && len(s) > 1 {
+		return labelSelector{key: s[1:], op: "!"}, nil
+	}
+	if s == "" || strings.ContainsAny(s, "!=~") {
+		return labelSelector{}, fmt.Errorf("invalid label selector %q", s)
+	}
+	return labelSelector{key: s}, nil
+}
+
+func (l labelSelector) Match(labels map[string]string) bool {
+	v, ok := labels[l.key]
+	switch l.op {
+	case "":
+		return ok
+	case "!":
+		return !ok
+	case "=":
+		return ok && v == l.value
+	case "!=":
+		return !ok || v != l.value
+	case "=~":
+		return ok && l.re.MatchString(v)
+	case "!~":
+		return !ok || !l.re.MatchString(v)
+	}
+	return false
+}
+
+// containerFilter selects the containers that are collected: all include
+// selectors must match and no exclude selector may match.
+type containerFilter struct {
+	include []labelSelector
+	exclude []labelSelector
+}
+
+var containerSelector *containerFilter
+
+func InitContainerFilter(cfg ContainersConfig) {
+	var err error
+	containerSelector, err = newContainerFilter(cfg)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func newContainerFilter(cfg ContainersConfig) (*containerFilter, error) {
+	f := &containerFilter{}
+	for _, s := range cfg.Include {
+		l, err := parseLabelSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, l)
+	}
+	for _, s := range cfg.Exclude {
+		l, err := parseLabelSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, l)
+	}
+	return f, nil
+}
+
+func (f *containerFilter) Match(labels map[string]string) bool {
+	for _, l := range f.include {
+		if !l.Match(labels) {
+			return false
+		}
+	}
+	for _, l := range f.exclude {
+		if l.Match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// dockerFilters returns the include selectors the engine can evaluate
+// itself, to cut down the container list sent through the tunnel. The
+// complete filter is still applied with Match.
+func (f *containerFilter) dockerFilters() filters.Args {
+	arg := filters.NewArgs()
+	for _, l := range f.include {
+		switch l.op {
+		case "":
+			arg.Add("label", l.key)
+		case "=":
+			arg.Add("label", l.key+"="+l.value)
+		}
+	}
+	return arg
+}
+
+// labelTags returns the tags promoted from container labels.
+func labelTags(labels map[string]string) map[string]string {
+	tags := make(map[string]string, len(conf.Containers.LabelTags))
+	for label, tag := range conf.Containers.LabelTags {
+		tags[tag] = labels[label]
+	}
+	return tags
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/redis.v5"
+)
+
+// Only the owner may extend or drop a lease, otherwise a replica that was
+// too slow could remove a lease taken over by another one.
+var (
+	renewLeaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+	releaseLeaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+)
+
+// nodeLease gives one collector replica exclusive use of a node. It is a
+// Redis key holding the replica id with a TTL that is renewed while the
+// lease is held, so the node is taken over once a dead replica's lease
+// expires.
+type nodeLease struct {
+	key   string
+	owner string
+	ttl   time.Duration
+
+	// ctx is cancelled when the lease is lost or released.
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// acquireNodeLease tries to take the collection lease of node id. It
+// reports false without error when another replica holds it.
+func acquireNodeLease(ctx context.Context, id string) (*nodeLease, bool, error) {
+	return acquireLease(ctx, fmt.Sprintf("metrics.lease.%s", id))
+}
+
+func acquireLease(ctx context.Context, key string) (*nodeLease, bool, error) {
+	l := &nodeLease{
+		key:   key,
+		owner: conf.Collector.ReplicaId,
+		ttl:   time.Duration(conf.Collector.LeaseTTL) * time.Second,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	ok, err := redisCli.SetNX(l.key, l.owner, l.ttl).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	go l.keepAlive()
+	return l, true, nil
+}
+
+func (l *nodeLease) keepAlive() {
+	defer close(l.done)
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+		}
+		n, err := renewLeaseScript.Run(redisCli, []string{l.key}, l.owner, int64(l.ttl/time.Millisecond)).Result()
+		if err != nil {
+			log.Printf("renew lease %s failed!err:=%v", l.key, err)
+			if time.Since(renewed) < l.ttl {
+				continue
+			}
+		} else if n == int64(1) {
+			renewed = time.Now()
+			continue
+		}
+		log.Printf("lease %s lost", l.key)
+		l.cancel()
+		return
+	}
+}
+
+// Release stops renewing the lease and drops it if still owned.
+func (l *nodeLease) Release() {
+	close(l.stop)
+	<-l.done
+	l.cancel()
+	err := releaseLeaseScript.Run(redisCli, []string{l.key}, l.owner).Err()
+	if err != nil {
+		log.Printf("release lease %s failed!err:=%v", l.key, err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// precisionDivisor returns the number of nanoseconds per unit of an
+// InfluxDB write precision.
+func precisionDivisor(precision string) (int64, error) {
+	switch precision {
+	case "ns", "n", "":
+		return int64(time.Nanosecond), nil
+	case "us", "u":
+		return int64(time.Microsecond), nil
+	case "ms":
+		return int64(time.Millisecond), nil
+	case "s":
+		return int64(time.Second), nil
+	}
+	return 0, fmt.Errorf("unknown precision %q", precision)
+}
+
+// appendLine encodes a sample as one line of InfluxDB line protocol.
+// Tags with empty values and non-finite float fields are dropped since the
+// protocol cannot represent them; a sample left without fields is skipped.
+func appendLine(buf *bytes.Buffer, s Sample, divisor int64) error {
+	keys := make([]string, 0, len(s.Fields))
+	for k, v := range s.Fields {
+		if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	fields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v, err := formatField(s.Fields[k])
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", s.Measurement, k, err)
+		}
+		fields = append(fields, keyEscaper.Replace(k)+"="+v)
+	}
+
+	buf.WriteString(measurementEscaper.Replace(s.Measurement))
+	keys = keys[:0]
+	for k, v := range s.Tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteByte(',')
+		buf.WriteString(keyEscaper.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(keyEscaper.Replace(s.Tags[k]))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strings.Join(fields, ","))
+
+	if !s.Time.IsZero() {
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(s.Time.UnixNano()/divisor, 10))
+	}
+	buf.WriteByte('\n')
+	return nil
+}
+
+func formatField(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case int:
+		return strconv.FormatInt(int64(v), 10) + "i", nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i", nil
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", nil
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10) + "i", nil
+	case uint64:
+		// 1.x has no unsigned type, values beyond int64 degrade to floats.
+		if v > math.MaxInt64 {
+			return strconv.FormatFloat(float64(v), 'f', -1, 64), nil
+		}
+		return strconv.FormatUint(v, 10) + "i", nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, nil
+	}
+	return "", fmt.Errorf("unsupported field type %T", v)
+}
+
+// parseLines decodes line protocol as written by appendLine, with
+// timestamps in units of divisor nanoseconds. Lines without a timestamp
+// get now. String fields may span lines, as health check output does.
+func parseLines(data []byte, divisor int64, now time.Time) ([]Sample, error) {
+	var samples []Sample
+	for i, line := range splitUnescaped(string(data), '\n', true) {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		s, err := parseLine(line, divisor, now)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+func parseLine(line string, divisor int64, now time.Time) (Sample, error) {
+	var sections []string
+	for _, part := range splitUnescaped(line, ' ', true) {
+		if part != "" {
+			sections = append(sections, part)
+		}
+	}
+	if len(sections) != 2 && len(sections) != 3 {
+		return Sample{}, fmt.Errorf("expected measurement, fields and an optional timestamp")
+	}
+
+	s := Sample{
+		Tags:   make(map[string]string),
+		Fields: make(map[string]interface{}),
+		Time:   now,
+	}
+	key := splitUnescaped(sections[0], ',', false)
+	s.Measurement = unescapeKey(key[0])
+	if s.Measurement == "" {
+		return s, fmt.Errorf("missing measurement")
+	}
+	for _, tag := range key[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" {
+			return s, fmt.Errorf("invalid tag %q", tag)
+		}
+		s.Tags[unescapeKey(kv[0])] = unescapeKey(kv[1])
+	}
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" {
+			return s, fmt.Errorf("invalid field %q", field)
+		}
+		v, err := parseFieldValue(kv[1])
+		if err != nil {
+			return s, fmt.Errorf("field %s: %v", kv[0], err)
+		}
+		s.Fields[unescapeKey(kv[0])] = v
+	}
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		s.Time = time.Unix(0, ts*divisor)
+	}
+	return s, nil
+}
+
+// splitUnescaped splits s at the occurrences of sep not escaped by a
+// backslash and, if quotes is set, not within a double quoted string.
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+var keyUnescaper = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\n`, "\n")
+
+func unescapeKey(s string) string {
+	return keyUnescaper.Replace(s)
+}
+
+var stringUnescaper = strings.NewReplacer(`\"`, `"`, `\\`, `\`)
+
+func parseFieldValue(v string) (interface{}, error) {
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		return stringUnescaper.Replace(v[1 : len(v)-1]), nil
+	}
+	if strings.HasSuffix(v, "i") {
+		return strconv.ParseInt(v[:len(v)-1], 10, 64)
+	}
+	if strings.HasSuffix(v, "u") {
+		return strconv.ParseUint(v[:len(v)-1], 10, 64)
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", v)
+	}
+	return f, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func nan() float64 {
+	return math.NaN()
+}
+
+func TestAppendLine(t *testing.T) {
+	ts := time.Unix(1500000000, 123456789)
+	tests := []struct {
+		name    string
+		sample  Sample
+		divisor int64
+		want    string
+	}{
+		{
+			name: "escaping",
+			sample: Sample{
+				Measurement: "cpu load,total",
+				Tags:        map[string]string{"host name": "a,b=c", "empty": ""},
+				Fields:      map[string]interface{}{"msg=x": `say "hi" \o/`},
+				Time:        ts,
+			},
+			divisor: 1,
+			want:    `cpu\ load\,total,host\ name=a\,b\=c msg\=x="say \"hi\" \\o/" 1500000000123456789` + "\n",
+		},
+		{
+			name: "field types",
+			sample: Sample{
+				Measurement: "m",
+				Fields: map[string]interface{}{
+					"f":   1.5,
+					"i":   int64(-3),
+					"n":   7,
+					"u":   uint64(42),
+					"big": uint64(1 << 63),
+					"t":   true,
+					"b":   false,
+					"s":   "x",
+				},
+				Time: ts,
+			},
+			divisor: int64(time.Second),
+			want:    `m b=false,big=9223372036854776000,f=1.5,i=-3i,n=7i,s="x",t=true,u=42i 1500000000` + "\n",
+		},
+		{
+			name: "non-finite floats dropped",
+			sample: Sample{
+				Measurement: "m",
+				Fields:      map[string]interface{}{"nan": nan(), "ok": 1.0},
+			},
+			divisor: 1,
+			want:    "m ok=1\n",
+		},
+		{
+			name: "no fields",
+			sample: Sample{
+				Measurement: "m",
+				Fields:      map[string]interface{}{"nan": nan()},
+			},
+			divisor: 1,
+			want:    "",
+		},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := appendLine(&buf, tt.sample, tt.divisor); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAppendLineUnsupported(t *testing.T) {
+	var buf bytes.Buffer
+	s := Sample{Measurement: "m", Fields: map[string]interface{}{"x": []int{1}}}
+	if err := appendLine(&buf, s, 1); err == nil {
+		t.Error("expected an error for a slice field")
+	}
+}
+
+func TestLineRoundTrip(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	in := []Sample{
+		{
+			Measurement: "docker container,x",
+			Tags:        map[string]string{"container name": "web=1,a", "node_id": "n1"},
+			Fields: map[string]interface{}{
+				"usage":   0.25,
+				"count":   int64(9),
+				"ok":      true,
+				"status":  `up "3" hours, \healthy\`,
+				"output":  "line1\nline2 \"x\"\n",
+				"key=a,b": int64(1),
+			},
+			Time: ts,
+		},
+		{
+			Measurement: "m",
+			Tags:        map[string]string{},
+			Fields:      map[string]interface{}{"v": -1.5},
+			Time:        ts.Add(time.Second),
+		},
+	}
+	var buf bytes.Buffer
+	for _, s := range in {
+		if err := appendLine(&buf, s, int64(time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := parseLines(buf.Bytes(), int64(time.Millisecond), time.Time{})
+	if err != nil {
+		t.Fatalf("parseLines(%q): %v", buf.String(), err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip of %q:\ngot  %#v\nwant %#v", buf.String(), out, in)
+	}
+}
+
+func TestParseLinesErrors(t *testing.T) {
+	for _, line := range []string{
+		"m",
+		"m a=1 2 3",
+		",t=1 a=1",
+		"m,t a=1",
+		"m a",
+		"m a=x",
+		"m a=1 ts",
+	} {
+		if _, err := parseLines([]byte(line), 1, time.Now()); err == nil {
+			t.Errorf("parseLines(%q): expected an error", line)
+		}
+	}
+}
+
+func TestParseLinesDefaults(t *testing.T) {
+	now := time.Unix(10, 0)
+	out, err := parseLines([]byte("# comment\n\nm u=3u,b=T\n"), 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Sample{{
+		Measurement: "m",
+		Tags:        map[string]string{},
+		Fields:      map[string]interface{}{"u": uint64(3), "b": true},
+		Time:        now,
+	}}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("got %#v, want %#v", out, want)
+	}
+}
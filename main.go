@@ -1,120 +1,242 @@
 package main
 
 import (
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
-	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/stackimpact/stackimpact-go"
+	"golang.org/x/net/context"
 )
 
-var healthCollectInterval int64 = 120
-var sleepInterval int64 = 6
-
 func main() {
-	var production string = "development"
-	if os.Getenv("PROD") == "true" || os.Getenv("PROD") == "1" {
-		production = "production"
+	dump, err := loadConfig(os.Args[1:])
+	if dump {
+		if derr := conf.dump(os.Stdout); derr != nil {
+			log.Fatalln("dump config failed!err:=", derr)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatalln(err)
 	}
 
+	srv := &http.Server{Addr: conf.Listen}
 	go func() {
-		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
+		log.Println(srv.ListenAndServe())
 	}()
-	agent := stackimpact.NewAgent()
-	agent.Start(stackimpact.Options{
-		AgentKey:       "d6ac427b372f9a5b2d93bb7ec47421a244112e65",
-		AppName:        "sr_metrics",
-		AppVersion:     "1.0.2",
-		AppEnvironment: production,
-	})
-
-	var err error
-	CollectInterval := os.Getenv("CollectInterval")
-	if CollectInterval != "" {
-		healthCollectInterval, err = strconv.ParseInt(CollectInterval, 10, 64)
-		if err != nil {
-			log.Fatalln("ParseInt CollectInterval failed!")
+	if conf.StackImpact.AgentKey != "" {
+		var production string = "development"
+		if conf.Production {
+			production = "production"
 		}
+		agent := stackimpact.NewAgent()
+		agent.Start(stackimpact.Options{
+			AgentKey:       conf.StackImpact.AgentKey,
+			AppName:        conf.StackImpact.AppName,
+			AppVersion:     "1.0.2",
+			AppEnvironment: production,
+		})
 	}
-	Sleep := os.Getenv("Sleep")
-	if Sleep != "" {
-		sleepInterval, err = strconv.ParseInt(Sleep, 10, 64)
-		if err != nil {
-			log.Fatalln("ParseInt CollectInterval failed!")
-		}
+
+	InitSinks(conf)
+	if conf.Mode == "agent" {
+		InitContainerFilter(conf.Containers)
+		runAgent(srv)
+		return
 	}
-	InitInflux()
-	InitMysql()
-	InitRedis()
+	InitMysql(conf.Mysql)
+	InitRedis(conf.Redis)
+	InitStatsCache(conf.Collector)
+	InitContainerFilter(conf.Containers)
+	InitIngest(conf.Ingest)
 
-	loopIdx := 0
 	healthyIds, err := listConnectedNodes()
 	if err != nil {
 		panic(err)
 	}
-	var goRoutineIdx int64 = 0
+	if err = refreshCollectPolicies(); err != nil {
+		panic(err)
+	}
+	var sched *scheduler
+	pool := newWorkerPool(conf.Collector.Workers, conf.Collector.QueueSize, func(ctx context.Context, id string) {
+		notDue, err := testAndLogNode(ctx, id)
+		sched.Finished(id, err != nil, notDue)
+	})
+	expvar.Publish("pool", expvar.Func(func() interface{} {
+		return pool.Stats()
+	}))
+	rand.Seed(time.Now().UnixNano())
+	sched = newScheduler(pool.Submit)
+	sched.Sync(healthyIds)
+	http.Handle("/debug/schedule", sched)
+	quit := make(chan struct{})
+	go sched.Run(quit)
+	var watchers *eventWatchers
+	if conf.Collector.Events {
+		watchers = newEventWatchers()
+		watchers.Sync(healthyIds)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 	for {
-		time.Sleep(time.Duration(int64(time.Second) * sleepInterval))
-		fmt.Println("goRoutineIdx:", atomic.LoadInt64(&goRoutineIdx))
-		loopIdx++
-		if loopIdx == 20 {
-			loopIdx = 0
-			healthyIds, err = listConnectedNodes()
-			if err != nil {
-				log.Println("listConnectedNodes failed,err:=", err)
-				continue
-			}
+		select {
+		case sig := <-stop:
+			log.Printf("received %v, shutting down", sig)
+			close(quit)
+			shutdown(srv, pool, watchers)
+			return
+		case <-time.After(time.Duration(int64(time.Second) * conf.Collector.Sleep)):
 		}
-		unCollectedIds, err := listUnCollectedNodes(healthyIds, 200)
+		ps := pool.Stats()
+		log.Printf("pool: running:%d queued:%d/%d completed:%d dropped:%d avg_wait:%v max_wait:%v avg_run:%v max_run:%v",
+			ps.Running, ps.QueueDepth, ps.QueueSize, ps.Completed, ps.Dropped, ps.AvgWait, ps.MaxWait, ps.AvgRun, ps.MaxRun)
+		if conf.Collector.SelfMetrics {
+			writeSelfMetrics(metricSink)
+		}
+		healthyIds, err = listConnectedNodes()
 		if err != nil {
-			log.Println("listUnCollectedNodes(200) failed,err:=", err)
+			log.Println("listConnectedNodes failed,err:=", err)
 			continue
 		}
-		log.Println("healthy:", len(healthyIds), " uncollected:", len(unCollectedIds))
-		if unCollectedIds == nil || len(unCollectedIds) == 0 {
-			continue
+		if err = refreshCollectPolicies(); err != nil {
+			log.Println("refreshCollectPolicies failed,err:=", err)
 		}
-		for i := range unCollectedIds {
-			go testAndLogNode(unCollectedIds[i], &goRoutineIdx)
+		sched.Sync(healthyIds)
+		if watchers != nil {
+			watchers.Sync(healthyIds)
 		}
+		log.Println("healthy:", len(healthyIds))
 	}
 }
 
-func testAndLogNode(id string, idx *int64) {
-	atomic.AddInt64(idx, 1)
-	defer atomic.AddInt64(idx, -1)
-	rows, err := markNodeCollected(id)
+// shutdown drains the in-flight collections and closes every client.
+func shutdown(srv *http.Server, pool *workerPool, watchers *eventWatchers) {
+	timeout := time.Duration(conf.Collector.ShutdownTimeout) * time.Second
+	if pool.Stop(timeout, 10*time.Second) {
+		log.Println("all collections finished")
+	} else {
+		log.Printf("collections still running after %v, cancelled", timeout)
+	}
+	if watchers != nil {
+		watchers.Stop()
+	}
+	if err := metricSink.Close(); err != nil {
+		log.Println("close sink failed!err:=", err)
+	}
+	CloseMysql()
+	CloseRedis()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("shutdown http server failed!err:=", err)
+	}
+}
+
+// testAndLogNode collects node id unless another replica holds it or
+// collected it already. It returns the error of a failed collection and,
+// for a node found not due yet, the time until it is.
+func testAndLogNode(ctx context.Context, id string) (time.Duration, error) {
+	lease, isok, err := acquireNodeLease(ctx, id)
 	if err != nil {
-		log.Println("markNodeCollected failed!err:=", err.Error())
-		return
+		log.Println("acquireNodeLease failed!err:=", err.Error())
+		return 0, err
 	}
-	if rows != 1 {
-		log.Printf("set node(%s) health_collect failed!num not match", id)
+	if !isok {
+		// Another replica is collecting the node.
+		return 0, nil
+	}
+	defer lease.Release()
+	// The node may have been collected by another replica between listing
+	// and leasing, check again now that no one else can touch it.
+	due, err := listUnCollectedNodes([]string{id}, 1)
+	if err != nil {
+		log.Println("listUnCollectedNodes(1) failed!err:=", err.Error())
+		return 0, err
+	}
+	if len(due) == 0 {
+		// Collected recently, by another replica or before a restart, or
+		// not a node that is collected at all.
+		delay, err := nodeCollectDelay(id)
+		if err != nil {
+			log.Println("nodeCollectDelay failed!err:=", err.Error())
+			return 0, err
+		}
+		if delay == 0 {
+			// Not collectable, as daomonits without a node row are,
+			// look at it again an interval later.
+			delay = time.Duration(nodeCollectClass(id).Interval) * time.Second
+		}
+		return delay, nil
+	}
+	ctx = lease.ctx
+
+	err = markNodeClaimed(id)
+	if err != nil {
+		log.Println("markNodeClaimed failed!err:=", err.Error())
+		return 0, err
+	}
+	cerr := collectNode(ctx, id)
+	if cerr != nil && ctx.Err() != nil {
+		// Interrupted by shutdown or lease loss, let the next run collect
+		// the node instead of waiting for a retry.
+		if err = releaseNodeClaim(id); err != nil {
+			log.Println("releaseNodeClaim failed!err:=", err.Error())
+		}
+		return 0, nil
+	}
+	if cerr != nil {
+		log.Printf("collect node(%s) failed!err:=%v", id, cerr)
+		if err = markNodeFailed(id, cerr); err != nil {
+			log.Println("markNodeFailed failed!err:=", err.Error())
+		}
+		return 0, cerr
+	}
+	if err = markNodeSucceeded(id); err != nil {
+		log.Println("markNodeSucceeded failed!err:=", err.Error())
 	}
+	return 0, nil
+}
+
+func collectNode(ctx context.Context, id string) error {
+	url, err := nodeDockerUrl(id)
+	if err != nil {
+		return err
+	}
+	return getMachineMetrics(ctx, id, url)
+}
 
+// nodeDockerUrl returns the address of the docker engine of node id
+// through its tunnel, if the tunnel is alive.
+func nodeDockerUrl(id string) (string, error) {
 	dts, isok, err := getNodeTunnel(id)
 	if err != nil {
-		log.Println("getNodeTunnel failed!err:=", err.Error())
-		return
+		return "", fmt.Errorf("getNodeTunnel failed!err:=%v", err)
 	}
 	if !isok {
-		return
+		return "", errors.New("no established docker tunnel")
 	}
 	isok, err = testTunnelAlive(dts)
 	if err != nil {
-		log.Println("testTunnelAlive failed!err:=", err.Error())
-		return
+		return "", fmt.Errorf("testTunnelAlive failed!err:=%v", err)
 	}
-	if isok {
-		if strings.HasPrefix(dts.PublicUrl, "tcp") {
-			dts.PublicUrl = strings.Replace(dts.PublicUrl, "tcp", "http", 1)
-		}
-		getMachineMetrics(dts.PublicUrl)
+	if !isok {
+		return "", fmt.Errorf("tunnel %s is not alive", dts.PublicUrl)
+	}
+	if strings.HasPrefix(dts.PublicUrl, "tcp") {
+		dts.PublicUrl = strings.Replace(dts.PublicUrl, "tcp", "http", 1)
 	}
+	return dts.PublicUrl, nil
 }
@@ -4,103 +4,183 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
 	dclient "github.com/docker/docker/client"
-	"github.com/fsouza/go-dockerclient"
-	"github.com/influxdb/influxdb/client"
 	"golang.org/x/net/context"
 )
 
-func calculateCpuPercent(previousCpu uint64, previousSystem uint64, currentCpu uint64, currentSystem uint64, cpuSize int) float64 {
-	cpuPercent := 0.0
-	cpuDelta := float64(currentCpu - previousCpu)
-	systemDelta := float64(currentSystem - previousSystem)
-
-	if cpuDelta > 0.0 && systemDelta > 0.0 {
-		cpuPercent = (cpuDelta / systemDelta) * float64(cpuSize)
-	}
-	return cpuPercent
-}
-
-func getMachineMetrics(tunnel string) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+func getMachineMetrics(ctx context.Context, id string, tunnel string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.Collector.NodeTimeout)*time.Second)
 	defer cancel()
-	cli, apiVersion, err := newClient(ctx, tunnel)
+	cli, version, err := newClient(ctx, tunnel)
 	if err != nil {
-		log.Printf("new docker client(%s,%s) failed!err:=%v\n", tunnel, apiVersion, err)
-		return
+		return fmt.Errorf("new docker client(%s) failed!err:=%v", tunnel, err)
 	}
 	defer cli.Close()
+	apiVersion := version.APIVersion
 	containers, err := listContainers(ctx, cli)
 	if err != nil {
-		log.Printf("list containers(%s,%s) failed!err:=%v\n", tunnel, apiVersion, err)
-		return
+		return fmt.Errorf("list containers(%s,%s) failed!err:=%v", tunnel, apiVersion, err)
 	}
-	pts := make([]client.Point, 0)
-	for _, c := range containers {
-		err = getContainerMetrics(ctx, cli, c, &pts)
-		if err != nil {
-			log.Printf("get container metrics(%s,%s) failed!err:=%v\n", tunnel, apiVersion, err)
-			break
+	pts, failed := collectContainers(ctx, cli, id, containers)
+	hinfo, err := cli.Info(ctx)
+	if err != nil {
+		log.Printf("docker info(%s,%s) failed!err:=%v", tunnel, apiVersion, err)
+	} else {
+		pts = append(pts, newSample("docker_host", map[string]string{"node_id": id}, hostFields(hinfo, version)))
+	}
+	var collectErr error
+	if failed > 0 {
+		log.Printf("get container metrics(%s,%s) failed for %d/%d containers", tunnel, apiVersion, failed, len(containers))
+		if failed == len(containers) {
+			collectErr = fmt.Errorf("get container metrics(%s,%s) failed for all %d containers", tunnel, apiVersion, failed)
 		}
 	}
 	if len(pts) > 0 {
-		err = writePoints(pts)
+		// Points already collected are written even when ctx was
+		// cancelled by a shutdown.
+		wctx, wcancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer wcancel()
+		err = metricSink.Write(wctx, pts)
 		if err != nil {
-			log.Printf("write points (%d,%s,%s) failed!err:=%v", len(pts), tunnel, apiVersion, err)
-			return
+			return fmt.Errorf("write points (%d,%s,%s) failed!err:=%v", len(pts), tunnel, apiVersion, err)
 		}
 		log.Printf("write points! pts:%d", len(pts))
 	}
+	return collectErr
+}
+
+// collectContainers collects the containers of a node with bounded
+// parallelism and a timeout per container. A container that fails does not
+// affect the others, it is reported as a docker_container_collect_error
+// sample next to the samples read before the failure. It returns the
+// samples and the number of failures.
+func collectContainers(ctx context.Context, cli *dclient.Client, nodeId string, containers []types.Container) ([]Sample, int) {
+	timeout := time.Duration(conf.Collector.ContainerTimeout) * time.Second
+	results := make([][]Sample, len(containers))
+	errs := make([]error, len(containers))
+	sem := make(chan struct{}, conf.Collector.ContainerConcurrency)
+	var wg sync.WaitGroup
+	for i := range containers {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			cctx, ccancel := context.WithTimeout(ctx, timeout)
+			defer ccancel()
+			errs[i] = getContainerMetrics(cctx, cli, nodeId, containers[i], &results[i])
+		}(i)
+	}
+	wg.Wait()
+
+	pts := make([]Sample, 0)
+	failed := 0
+	for i, c := range containers {
+		// Inventory and health are read before the stats that may fail.
+		pts = append(pts, results[i]...)
+		if errs[i] != nil {
+			failed++
+			log.Printf("get container metrics(%s) failed!err:=%v", c.ID, errs[i])
+			fields := map[string]interface{}{"error": errs[i].Error()}
+			pts = append(pts, newSample("docker_container_collect_error", containerTags(nodeId, c), fields))
+		}
+	}
+	return pts, failed
 }
 
-func newClient(ctx context.Context, tunnel string) (*dclient.Client, string, error) {
-	var cli *dclient.Client
-	var err error
+func newClient(ctx context.Context, tunnel string) (cli *dclient.Client, v types.Version, err error) {
+	defer observeStage(stageNewClient, time.Now(), &err)
 	cli, err = dclient.NewClient(tunnel, "1.17", nil, nil)
 	if err != nil {
-		cli.Close()
 		log.Printf("dclient.NewClient (%s) failed!err:=%v\n", tunnel, err)
-		return nil, "", err
+		return nil, types.Version{}, err
 	}
-	v, err := cli.ServerVersion(ctx)
+	v, err = cli.ServerVersion(ctx)
 	if err != nil {
 		cli.Close()
 		log.Printf("cli.ServerVersion (%s) failed!err:=%v\n", tunnel, err)
-		return nil, "", err
+		return nil, types.Version{}, err
 	}
 	if v.APIVersion == "" {
 		cli.Close()
-		log.Printf("APIVersion is empty(%s)\n", tunnel, err)
-		return nil, "", fmt.Errorf("apiversion invalid")
+		log.Printf("APIVersion is empty(%s)\n", tunnel)
+		return nil, types.Version{}, fmt.Errorf("apiversion invalid")
 	}
 	if v.APIVersion != "1.17" {
 		cli.Close()
 		cli, err = dclient.NewClient(tunnel, v.APIVersion, nil, nil)
 		if err != nil {
-			cli.Close()
 			log.Printf("dclient.NewClient (%s,%s) failed!err:=%v\n", tunnel, v.APIVersion, err)
-			return nil, "", err
+			return nil, types.Version{}, err
 		}
 	}
-	return cli, v.APIVersion, nil
+	return cli, v, nil
 }
 
 func listContainers(ctx context.Context, cli *dclient.Client) ([]types.Container, error) {
-	arg := filters.NewArgs()
-	arg.Add("label", "io.daocloud.sr.microservice-id")
-	opt := types.ContainerListOptions{Filters: arg}
+	// Stopped containers are listed too for the inventory.
+	opt := types.ContainerListOptions{All: true, Filters: containerSelector.dockerFilters()}
+	start := time.Now()
 	containers, err := cli.ContainerList(ctx, opt)
+	observeStage(stageContainerList, start, &err)
 	if err != nil {
 		return nil, err
 	}
-	return containers, nil
+	selected := make([]types.Container, 0, len(containers))
+	for _, c := range containers {
+		if containerSelector.Match(c.Labels) {
+			selected = append(selected, c)
+		}
+	}
+	return selected, nil
+}
+
+// readContainerStats returns two frames to compute rates from. In stream
+// mode they are two consecutive frames of the stats stream; in oneshot
+// mode a single frame is read and the previous one comes from the stats
+// cache, or is cur itself the first time a container is seen.
+func readContainerStats(ctx context.Context, cli *dclient.Client, id string) (prev *containerStats, cur *containerStats, err error) {
+	defer observeStage(stageContainerStats, time.Now(), &err)
+	stream := conf.Collector.StatsMode == "stream"
+	cs, err := cli.ContainerStats(ctx, id, stream)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cs.Body.Close()
+	decoder := json.NewDecoder(cs.Body)
+	if stream {
+		prev, err = decodeStats(decoder)
+		if err != nil {
+			return nil, nil, err
+		}
+		cur, err = decodeStats(decoder)
+		if err != nil {
+			return nil, nil, err
+		}
+		return prev, cur, nil
+	}
+
+	cur, err = decodeStats(decoder)
+	if err != nil {
+		return nil, nil, err
+	}
+	prev, swapErr := containerStatsCache.Swap(id, cur)
+	if swapErr != nil {
+		log.Printf("swap cached stats(%s) failed!err:=%v", id, swapErr)
+	}
+	if prev == nil {
+		prev = cur
+	}
+	return prev, cur, nil
 }
 
-func getContainerMetrics(ctx context.Context, cli *dclient.Client, c types.Container, pts *[]client.Point) error {
+func containerTags(nodeId string, c types.Container) map[string]string {
 	cname := ""
 	if c.Names != nil && len(c.Names) > 0 && len(c.Names[0]) > 0 {
 		if []byte(c.Names[0])[0] == byte('/') {
@@ -109,71 +189,41 @@ func getContainerMetrics(ctx context.Context, cli *dclient.Client, c types.Conta
 			cname = c.Names[0]
 		}
 	}
-	tags := map[string]string{
-		"micro_service_id": c.Labels["io.daocloud.sr.microservice-id"],
-		"container_name":   cname,
-		"container_id":     c.ID,
+	tags := labelTags(c.Labels)
+	tags["container_name"] = cname
+	tags["container_id"] = c.ID
+	tags["node_id"] = nodeId
+	return tags
+}
+
+func getContainerMetrics(ctx context.Context, cli *dclient.Client, nodeId string, c types.Container, pts *[]Sample) error {
+	tags := containerTags(nodeId, c)
+	info, err := cli.ContainerInspect(ctx, c.ID)
+	if err != nil {
+		return err
+	}
+	*pts = append(*pts, newSample("docker_container_info", tags, containerInfoFields(c, info)))
+	if info.ContainerJSONBase != nil && info.State != nil && info.State.Health != nil {
+		*pts = append(*pts, newSample("docker_container_health", tags, healthFields(info.State.Health)))
+	}
+	if info.ContainerJSONBase == nil || info.State == nil || !info.State.Running {
+		return nil
 	}
-	var preNetRx uint64
-	var preNetTx uint64
-	var preSet bool
-	cs, err := cli.ContainerStats(ctx, c.ID, true)
+	prev, cur, err := readContainerStats(ctx, cli, c.ID)
 	if err != nil {
 		return err
 	}
-	decoder := json.NewDecoder(cs.Body)
-	for {
-		s := new(docker.Stats)
-		err := decoder.Decode(s)
+	*pts = append(*pts, containerSamples(tags, info, prev, cur)...)
+
+	// Take a process listing of containers about to fork bomb.
+	threshold := conf.Collector.ProcessSnapshotThreshold
+	if threshold > 0 && cur.PidsStats.Current >= threshold {
+		top, err := cli.ContainerTop(ctx, c.ID, nil)
 		if err != nil {
-			return err
-		}
-		var rxBytes uint64
-		var txBytes uint64
-		if s.Networks != nil {
-			for _, v := range s.Networks {
-				rxBytes += v.RxBytes
-				txBytes += v.TxBytes
-			}
-		}
-		if !preSet {
-			preNetRx = rxBytes
-			preNetTx = txBytes
-			preSet = true
-		} else {
-			preSystemCpuUsage := s.PreCPUStats.SystemCPUUsage
-			systemCpuUsage := s.CPUStats.SystemCPUUsage
-			preCpuUsage := s.PreCPUStats.CPUUsage
-			cpuUsage := s.CPUStats.CPUUsage
-			cpuSize := 0
-			if cpuUsage.PercpuUsage != nil {
-				cpuSize = len(cpuUsage.PercpuUsage)
-			}
-			cpuFields := map[string]interface{}{
-				"usermode_percent":    calculateCpuPercent(preCpuUsage.UsageInUsermode, preSystemCpuUsage, cpuUsage.UsageInUsermode, systemCpuUsage, cpuSize),
-				"kernelmode_percent":  calculateCpuPercent(preCpuUsage.UsageInKernelmode, preSystemCpuUsage, cpuUsage.UsageInKernelmode, systemCpuUsage, cpuSize),
-				"total_percent":       calculateCpuPercent(preCpuUsage.TotalUsage, preSystemCpuUsage, cpuUsage.TotalUsage, systemCpuUsage, cpuSize),
-				"total_usage":         cpuUsage.TotalUsage,
-				"usage_in_usermode":   cpuUsage.UsageInUsermode,
-				"usage_in_kernelmode": cpuUsage.UsageInKernelmode,
-				"system_cpu_usage":    systemCpuUsage,
-				"cpu_size":            cpuSize,
-			}
-			memFields := map[string]interface{}{
-				"usage":     s.MemoryStats.Usage,
-				"limit":     s.MemoryStats.Limit,
-				"max_usage": s.MemoryStats.MaxUsage,
-			}
-			netFields := map[string]interface{}{
-				"rx_bytes":     rxBytes,
-				"tx_bytes":     txBytes,
-				"rx_bandwidth": rxBytes - preNetRx,
-				"tx_bandwidth": txBytes - preNetTx,
-			}
-			*pts = append(*pts, newPoints("docker_container_cpu", tags, cpuFields))
-			*pts = append(*pts, newPoints("docker_container_mem", tags, memFields))
-			*pts = append(*pts, newPoints("docker_container_network", tags, netFields))
+			log.Printf("top container(%s) failed!err:=%v", c.ID, err)
 			return nil
 		}
+		*pts = append(*pts, processSamples(tags, top, conf.Collector.ProcessSnapshotLimit)...)
 	}
+	return nil
 }
@@ -2,7 +2,8 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"log"
+	"strconv"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -29,24 +30,33 @@ type Node struct {
 	HealthCollectAt time.Time `xorm:"TIMESTAMP"`
 }
 
-var DaoKeeperDB *xorm.Engine
-var DaoSRDB *xorm.Engine
+// NodeCollectState records the collection lifecycle of a node next to the
+// node table. A node is claimed when a worker starts on it and ends up
+// succeeded or failed; failed nodes are retried after NextRetryAt.
+type NodeCollectState struct {
+	NodeId        string    `xorm:"pk varchar(64)"`
+	State         string    `xorm:"varchar(16) index"`
+	Owner         string    `xorm:"varchar(128)"`
+	ClaimedAt     time.Time `xorm:"TIMESTAMP null"`
+	LastSuccessAt time.Time `xorm:"TIMESTAMP null"`
+	LastFailureAt time.Time `xorm:"TIMESTAMP null"`
+	NextRetryAt   time.Time `xorm:"TIMESTAMP null"`
+	Failures      int       `xorm:"not null default 0"`
+	LastError     string    `xorm:"varchar(255)"`
+}
 
 const (
-	connstr = "root:dangerous@tcp(192.168.1.25:3306)/daokeeper?charset=utf8"
+	collectClaimed   = "claimed"
+	collectSucceeded = "succeeded"
+	collectFailed    = "failed"
 )
 
-func InitMysql() {
-	DaoKeeperConnStr := os.Getenv("DAOKEEPER")
-	if DaoKeeperConnStr == "" {
-		DaoKeeperConnStr = "root:dangerous@tcp(192.168.1.25:3306)/daokeeper?charset=utf8"
-	}
-	DaoSrConnStr := os.Getenv("DAOSR")
-	if DaoSrConnStr == "" {
-		DaoSrConnStr = "root:dangerous@tcp(192.168.1.25:3306)/daokeeper?charset=utf8"
-	}
+var DaoKeeperDB *xorm.Engine
+var DaoSRDB *xorm.Engine
+
+func InitMysql(cfg MysqlConfig) {
 	var err error
-	DaoKeeperDB, err = xorm.NewEngine("mysql", DaoKeeperConnStr)
+	DaoKeeperDB, err = xorm.NewEngine("mysql", cfg.DaoKeeper)
 	if err != nil {
 		panic(err)
 	}
@@ -54,7 +64,7 @@ func InitMysql() {
 	if err != nil {
 		panic(err)
 	}
-	DaoSRDB, err = xorm.NewEngine("mysql", DaoSrConnStr)
+	DaoSRDB, err = xorm.NewEngine("mysql", cfg.DaoSR)
 	if err != nil {
 		panic(err)
 	}
@@ -62,13 +72,27 @@ func InitMysql() {
 	if err != nil {
 		panic(err)
 	}
+	err = DaoSRDB.Sync2(new(NodeCollectState), new(NodeCollectPolicy))
+	if err != nil {
+		panic(err)
+	}
 }
 
-func getNodeTunnel(id string) (DaomonitTunnelStat, bool, error) {
+func CloseMysql() {
+	if err := DaoKeeperDB.Close(); err != nil {
+		log.Println("close daokeeper db failed!err:=", err)
+	}
+	if err := DaoSRDB.Close(); err != nil {
+		log.Println("close daosr db failed!err:=", err)
+	}
+}
+
+func getNodeTunnel(id string) (tunnel DaomonitTunnelStat, found bool, err error) {
+	defer observeStage(stageGetNodeTunnel, time.Now(), &err)
 	var tunnels []DaomonitTunnelStat = make([]DaomonitTunnelStat, 0)
-	err := DaoKeeperDB.Where("daomonit_id=?", id).And("is_established=?", true).And("local_addr=?", "unix:///var/run/docker.sock").Desc("updated_at").Limit(1).Find(&tunnels)
+	err = DaoKeeperDB.Where("daomonit_id=?", id).And("is_established=?", true).And("local_addr=?", "unix:///var/run/docker.sock").Desc("updated_at").Limit(1).Find(&tunnels)
 	if err != nil {
-		return DaomonitTunnelStat{}, false, nil
+		return DaomonitTunnelStat{}, false, err
 	}
 	if tunnels == nil || len(tunnels) == 0 {
 		return DaomonitTunnelStat{}, false, nil
@@ -82,9 +106,9 @@ func markNodesCollected(ids []string) (int64, error) {
 	return DaoSRDB.In("node_id", ids).Cols("health_collect_at").Update(&node)
 }
 
-func markNodeCollected(id string) (int64, error) {
+func markNodeCollected(sess *xorm.Session, id string) (int64, error) {
 	sql := "update node set health_collect_at=CURRENT_TIMESTAMP() where node_id=?"
-	result, err := DaoSRDB.Exec(sql, id)
+	result, err := sess.Exec(sql, id)
 	if err != nil {
 		return 0, err
 	}
@@ -95,25 +119,122 @@ func markNodeCollected(id string) (int64, error) {
 	return affected, err
 }
 
+func markNodeClaimed(id string) error {
+	sql := "insert into node_collect_state (node_id,state,owner,claimed_at) values (?,?,?,CURRENT_TIMESTAMP()) " +
+		"on duplicate key update state=values(state),owner=values(owner),claimed_at=values(claimed_at)"
+	_, err := DaoSRDB.Exec(sql, id, collectClaimed, conf.Collector.ReplicaId)
+	return err
+}
+
+// markNodeSucceeded sets health_collect_at, which keeps the node off
+// listUnCollectedNodes for a collect interval, and records the success.
+func markNodeSucceeded(id string) error {
+	sess := DaoSRDB.NewSession()
+	defer sess.Close()
+	err := sess.Begin()
+	if err != nil {
+		return err
+	}
+	rows, err := markNodeCollected(sess, id)
+	if err != nil {
+		sess.Rollback()
+		return err
+	}
+	if rows != 1 {
+		log.Printf("set node(%s) health_collect failed!num not match", id)
+	}
+	sql := "update node_collect_state set state=?,last_success_at=CURRENT_TIMESTAMP(),failures=0,next_retry_at=NULL,last_error='' where node_id=?"
+	_, err = sess.Exec(sql, collectSucceeded, id)
+	if err != nil {
+		sess.Rollback()
+		return err
+	}
+	return sess.Commit()
+}
+
+// markNodeFailed records a failed collection and schedules a retry after
+// retryBackoff doubled for every consecutive failure, at most one collect
+// interval.
+func markNodeFailed(id string, cause error) error {
+	msg := cause.Error()
+	if len(msg) > 255 {
+		msg = msg[:255]
+	}
+	// MySQL assigns left to right, next_retry_at still sees the previous
+	// failures count.
+	sql := "update node_collect_state set state=?,last_failure_at=CURRENT_TIMESTAMP()," +
+		"next_retry_at=(NOW() + INTERVAL LEAST(?*POW(2,LEAST(failures,16)),?) SECOND)," +
+		"failures=failures+1,last_error=? where node_id=?"
+	_, err := DaoSRDB.Exec(sql, collectFailed, conf.Collector.RetryBackoff, nodeCollectClass(id).Interval, msg, id)
+	return err
+}
+
+// releaseNodeClaim makes a node interrupted by a shutdown or a lost lease
+// immediately eligible again without counting it as a failure.
+func releaseNodeClaim(id string) error {
+	sql := "update node_collect_state set state=?,next_retry_at=CURRENT_TIMESTAMP(),last_error='interrupted' where node_id=? and state=? and owner=?"
+	_, err := DaoSRDB.Exec(sql, collectFailed, id, collectClaimed, conf.Collector.ReplicaId)
+	return err
+}
+
+// listUnCollectedNodes returns up to limit nodes of ids that are due
+// according to the interval of their class and not busy.
 func listUnCollectedNodes(ids []string, limit int) ([]string, error) {
 	if ids == nil || len(ids) == 0 {
 		return []string{}, nil
 	}
-	var nodes []Node
-	err := DaoSRDB.In("node_id", ids).And(fmt.Sprintf("(health_collect_at<(NOW() - INTERVAL %d SECOND) or health_collect_at is null)", healthCollectInterval)).Asc("health_collect_at").Limit(limit).Find(&nodes)
-	if err != nil {
-		return []string{}, err
+	byInterval := make(map[int64][]string)
+	for _, id := range ids {
+		interval := nodeCollectClass(id).Interval
+		byInterval[interval] = append(byInterval[interval], id)
 	}
 	var idsFilters []string = make([]string, 0)
-	for i := range nodes {
-		idsFilters = append(idsFilters, nodes[i].NodeId)
+	busy := "node_id not in (select node_id from node_collect_state where (state=? and claimed_at>(NOW() - INTERVAL ? SECOND)) or (state=? and next_retry_at>NOW()))"
+	for interval, group := range byInterval {
+		var nodes []Node
+		// health_collect_at has second precision, a node whose interval
+		// ends within the current second is due already.
+		err := DaoSRDB.In("node_id", group).And(fmt.Sprintf("(health_collect_at<=(NOW() - INTERVAL %d SECOND) or health_collect_at is null)", interval-1)).And(busy, collectClaimed, conf.Collector.ClaimTimeout, collectFailed).Asc("health_collect_at").Limit(limit - len(idsFilters)).Find(&nodes)
+		if err != nil {
+			return []string{}, err
+		}
+		for i := range nodes {
+			idsFilters = append(idsFilters, nodes[i].NodeId)
+		}
+		if len(idsFilters) >= limit {
+			break
+		}
 	}
 	return idsFilters, nil
 }
 
-func listConnectedNodes() ([]string, error) {
+// nodeCollectDelay returns the time until node id is due again according
+// to its last collection and its claim or retry. It uses the database
+// clock like listUnCollectedNodes. Zero means nothing keeps the node from
+// being due, or that it has no node row and is never collected.
+func nodeCollectDelay(id string) (time.Duration, error) {
+	sql := "select greatest(0," +
+		"coalesce(timestampdiff(second,NOW(),health_collect_at + INTERVAL ? SECOND),0)," +
+		"coalesce((select timestampdiff(second,NOW(),if(state=?,claimed_at + INTERVAL ? SECOND,next_retry_at)) from node_collect_state where node_id=? and state in (?,?)),0)) as delay " +
+		"from node where node_id=?"
+	rows, err := DaoSRDB.Query(sql, nodeCollectClass(id).Interval-1, collectClaimed, conf.Collector.ClaimTimeout, id, collectClaimed, collectFailed, id)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	delay, err := strconv.ParseInt(string(rows[0]["delay"]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(delay) * time.Second, nil
+}
+
+func listConnectedNodes() (nodeIds []string, err error) {
+	defer observeStage(stageListConnectedNodes, time.Now(), &err)
 	var daomonits []Daomonit = make([]Daomonit, 0)
-	err := DaoKeeperDB.Where("is_login=?", true).And("heartbeat_at>(NOW() - INTERVAL 25 SECOND)").Find(&daomonits)
+	err = DaoKeeperDB.Where("is_login=?", true).And("heartbeat_at>(NOW() - INTERVAL 25 SECOND)").Find(&daomonits)
 	if err != nil {
 		return []string{}, err
 	}
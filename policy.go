@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// NodeCollectPolicy assigns a node to one of the collector.classes. Nodes
+// without a row, or with a class the config does not define, are collected
+// every collect_interval with priority 0.
+type NodeCollectPolicy struct {
+	NodeId string `xorm:"pk varchar(64)"`
+	Class  string `xorm:"varchar(32)"`
+}
+
+// nodeClasses caches node_collect_policy, refreshed with the connected
+// nodes.
+var nodeClasses = struct {
+	sync.RWMutex
+	byNode map[string]string
+}{byNode: make(map[string]string)}
+
+func refreshCollectPolicies() error {
+	var policies []NodeCollectPolicy
+	err := DaoSRDB.Find(&policies)
+	if err != nil {
+		return err
+	}
+	byNode := make(map[string]string, len(policies))
+	for _, p := range policies {
+		if _, ok := conf.Collector.Classes[p.Class]; !ok {
+			log.Printf("node %s has unknown collect class %q", p.NodeId, p.Class)
+			continue
+		}
+		byNode[p.NodeId] = p.Class
+	}
+	nodeClasses.Lock()
+	nodeClasses.byNode = byNode
+	nodeClasses.Unlock()
+	return nil
+}
+
+// nodeCollectClass returns the class of node id.
+func nodeCollectClass(id string) CollectClass {
+	nodeClasses.RLock()
+	name, ok := nodeClasses.byNode[id]
+	nodeClasses.RUnlock()
+	if !ok {
+		return CollectClass{Interval: conf.Collector.CollectInterval}
+	}
+	return conf.Collector.Classes[name]
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// workerPool runs collections on a fixed number of workers fed by a bounded
+// queue. A node id is accepted at most once until its run completes.
+type workerPool struct {
+	fn     func(ctx context.Context, id string)
+	queue  chan poolTask
+	ctx    context.Context
+	cancel context.CancelFunc
+	quit   chan struct{}
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	pending map[string]bool
+	stopped bool
+	stats   poolStats
+}
+
+type poolTask struct {
+	id     string
+	queued time.Time
+}
+
+// poolStats are cumulative since the pool was started, except QueueDepth
+// and Running which are current values.
+type poolStats struct {
+	Workers    int
+	QueueSize  int
+	QueueDepth int
+	Running    int
+	Submitted  int64
+	Completed  int64
+	Dropped    int64
+	Duplicates int64
+	AvgWait    time.Duration
+	MaxWait    time.Duration
+	AvgRun     time.Duration
+	MaxRun     time.Duration
+
+	totalWait time.Duration
+	totalRun  time.Duration
+}
+
+// newWorkerPool starts workers running fn. The context passed to fn is
+// cancelled when Stop gives up waiting for in-flight runs.
+func newWorkerPool(workers int, queueSize int, fn func(ctx context.Context, id string)) *workerPool {
+	p := &workerPool{
+		fn:      fn,
+		queue:   make(chan poolTask, queueSize),
+		quit:    make(chan struct{}),
+		pending: make(map[string]bool),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.stats.Workers = workers
+	p.stats.QueueSize = queueSize
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// submitResult is the outcome of Submit.
+type submitResult int
+
+const (
+	submitAccepted submitResult = iota
+	// submitDuplicate is returned for a node already queued or running.
+	submitDuplicate
+	submitFull
+	submitStopped
+)
+
+// Submit queues id unless it is already queued or running, the queue is
+// full or the pool is stopped. It reports which.
+func (p *workerPool) Submit(id string) submitResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		p.stats.Dropped++
+		return submitStopped
+	}
+	if p.pending[id] {
+		p.stats.Duplicates++
+		return submitDuplicate
+	}
+	select {
+	case p.queue <- poolTask{id: id, queued: time.Now()}:
+		p.pending[id] = true
+		p.stats.Submitted++
+		return submitAccepted
+	default:
+		p.stats.Dropped++
+		return submitFull
+	}
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for {
+		var t poolTask
+		select {
+		case <-p.quit:
+			return
+		case t = <-p.queue:
+		}
+		select {
+		case <-p.quit:
+			// Stopping, leave the node to the next run of the collector.
+			p.mu.Lock()
+			delete(p.pending, t.id)
+			p.mu.Unlock()
+			return
+		default:
+		}
+
+		start := time.Now()
+		wait := start.Sub(t.queued)
+		p.mu.Lock()
+		p.stats.Running++
+		p.stats.totalWait += wait
+		if wait > p.stats.MaxWait {
+			p.stats.MaxWait = wait
+		}
+		p.mu.Unlock()
+
+		p.fn(p.ctx, t.id)
+
+		run := time.Since(start)
+		p.mu.Lock()
+		delete(p.pending, t.id)
+		p.stats.Running--
+		p.stats.Completed++
+		p.stats.totalRun += run
+		if run > p.stats.MaxRun {
+			p.stats.MaxRun = run
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Stop stops accepting and starting runs and waits up to timeout for the
+// in-flight ones. Runs still going after timeout get their context
+// cancelled and are given grace to wind down. Stop reports whether all
+// runs finished within timeout.
+func (p *workerPool) Stop(timeout time.Duration, grace time.Duration) bool {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	close(p.quit)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	defer p.cancel()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+	p.cancel()
+	select {
+	case <-done:
+	case <-time.After(grace):
+	}
+	return false
+}
+
+func (p *workerPool) Stats() poolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.QueueDepth = len(p.queue)
+	if started := s.Completed + int64(s.Running); started > 0 {
+		s.AvgWait = s.totalWait / time.Duration(started)
+	}
+	if s.Completed > 0 {
+		s.AvgRun = s.totalRun / time.Duration(s.Completed)
+	}
+	return s
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	http.Handle("/metrics", promExporter)
+	registerSink("prometheus", func(cfg Config) (Sink, error) {
+		ttl := cfg.Prometheus.TTL
+		if ttl == 0 {
+			ttl = 3 * cfg.Collector.maxInterval()
+		}
+		promExporter.setTTL(time.Duration(ttl) * time.Second)
+		return promExporter, nil
+	})
+}
+
+// promCounters lists the sample fields that only ever grow and are exposed
+// as counters; every other numeric field is a gauge.
+var promCounters = map[string]bool{
+	"docker_container_cpu.total_usage":                true,
+	"docker_container_cpu.usage_in_usermode":          true,
+	"docker_container_cpu.usage_in_kernelmode":        true,
+	"docker_container_cpu.system_cpu_usage":           true,
+	"docker_container_cpu_throttle.periods":           true,
+	"docker_container_cpu_throttle.throttled_periods": true,
+	"docker_container_cpu_throttle.throttled_time":    true,
+	"docker_container_cpu_core.usage":                 true,
+	"docker_container_info.restart_count":             true,
+	"docker_container_mem.failcnt":                    true,
+	"docker_container_mem.pgmajfault":                 true,
+	"docker_container_network.rx_bytes":               true,
+	"docker_container_network.tx_bytes":               true,
+	"docker_container_network.rx_packets":             true,
+	"docker_container_network.tx_packets":             true,
+	"docker_container_network.rx_errors":              true,
+	"docker_container_network.tx_errors":              true,
+	"docker_container_network.rx_dropped":             true,
+	"docker_container_network.tx_dropped":             true,
+	"docker_container_network_interface.rx_bytes":     true,
+	"docker_container_network_interface.tx_bytes":     true,
+	"docker_container_network_interface.rx_packets":   true,
+	"docker_container_network_interface.tx_packets":   true,
+	"docker_container_network_interface.rx_errors":    true,
+	"docker_container_network_interface.tx_errors":    true,
+	"docker_container_network_interface.rx_dropped":   true,
+	"docker_container_network_interface.tx_dropped":   true,
+	"docker_container_blkio.read_bytes":               true,
+	"docker_container_blkio.write_bytes":              true,
+	"docker_container_blkio.read_ops":                 true,
+	"docker_container_blkio.write_ops":                true,
+	"docker_container_blkio.io_wait_time":             true,
+	"docker_container_blkio.io_service_time":          true,
+}
+
+type promSeries struct {
+	name    string
+	labels  string
+	counter bool
+	value   float64
+	updated time.Time
+}
+
+// promExporterSink keeps the latest value of every sample field and serves
+// them in the Prometheus text exposition format. Series that are not
+// updated within the TTL are dropped so removed containers disappear.
+type promExporterSink struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	series map[string]*promSeries
+}
+
+var promExporter = &promExporterSink{series: make(map[string]*promSeries)}
+
+func (p *promExporterSink) setTTL(ttl time.Duration) {
+	p.mu.Lock()
+	p.ttl = ttl
+	p.mu.Unlock()
+}
+
+func (p *promExporterSink) Write(ctx context.Context, samples []Sample) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range samples {
+		if s.Measurement == "collector_self" {
+			// Served as collector_stage_* already.
+			continue
+		}
+		labels := promLabels(s.Tags)
+		for field, v := range s.Fields {
+			value, ok := promValue(v)
+			if !ok {
+				continue
+			}
+			counter := promCounters[s.Measurement+"."+field]
+			name := promName(s.Measurement + "_" + field)
+			if counter {
+				name += "_total"
+			}
+			key := name + labels
+			ps, ok := p.series[key]
+			if !ok {
+				ps = &promSeries{name: name, labels: labels, counter: counter}
+				p.series[key] = ps
+			}
+			ps.value = value
+			ps.updated = s.Time
+		}
+	}
+	return nil
+}
+
+func (p *promExporterSink) Close() error {
+	return nil
+}
+
+func (p *promExporterSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	now := time.Now()
+	series := make([]*promSeries, 0, len(p.series))
+	for key, ps := range p.series {
+		if p.ttl > 0 && now.Sub(ps.updated) > p.ttl {
+			delete(p.series, key)
+			continue
+		}
+		cp := *ps
+		series = append(series, &cp)
+	}
+	p.mu.Unlock()
+
+	sort.Sort(promSeriesByName(series))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	for i, ps := range series {
+		if i == 0 || series[i-1].name != ps.name {
+			kind := "gauge"
+			if ps.counter {
+				kind = "counter"
+			}
+			fmt.Fprintf(bw, "# TYPE %s %s\n", ps.name, kind)
+		}
+		fmt.Fprintf(bw, "%s%s %s\n", ps.name, ps.labels, strconv.FormatFloat(ps.value, 'g', -1, 64))
+	}
+	selfMetrics.writeProm(bw)
+	bw.Flush()
+}
+
+type promSeriesByName []*promSeries
+
+func (s promSeriesByName) Len() int      { return len(s) }
+func (s promSeriesByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s promSeriesByName) Less(i, j int) bool {
+	if s[i].name != s[j].name {
+		return s[i].name < s[j].name
+	}
+	return s[i].labels < s[j].labels
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabels renders tags as a sorted Prometheus label set.
+func promLabels(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, promName(k)+`="`+promLabelEscaper.Replace(tags[k])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// promName replaces the characters Prometheus does not allow in metric and
+// label names.
+func promName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func promValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
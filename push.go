@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+func init() {
+	registerSink("push", func(cfg Config) (Sink, error) {
+		return newPushSink(cfg.Push, cfg.Agent.NodeId, nil), nil
+	})
+}
+
+// pushSink sends samples to the /ingest endpoint of a collector, for
+// agents on nodes the collector cannot pull from.
+type pushSink struct {
+	client *http.Client
+	url    string
+	nodeId string
+	token  string
+}
+
+// newPushSink builds a sink pushing as node nodeId. A nil client uses a
+// default client with cfg.Timeout.
+func newPushSink(cfg PushConfig, nodeId string, client *http.Client) *pushSink {
+	if client == nil {
+		client = &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second}
+	}
+	return &pushSink{
+		client: client,
+		url:    strings.TrimRight(cfg.Addr, "/") + "/ingest",
+		nodeId: nodeId,
+		token:  cfg.Token,
+	}
+}
+
+func (s *pushSink) Write(ctx context.Context, samples []Sample) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	var line bytes.Buffer
+	for _, sample := range samples {
+		line.Reset()
+		if err := appendLine(&line, sample, 1); err != nil {
+			return err
+		}
+		if _, err := line.WriteTo(zw); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Node-Id", s.nodeId)
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := ctxhttp.Do(ctx, s.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("push: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *pushSink) Close() error {
+	return nil
+}
@@ -2,32 +2,36 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"log"
+	"time"
 
 	"gopkg.in/redis.v5"
 )
 
 var redisCli *redis.Client
 
-func InitRedis() {
-	redisAddr := os.Getenv("REDIS")
-	if redisAddr == "" {
-		redisAddr = "192.168.1.26:6379"
-	}
+func InitRedis(cfg RedisConfig) {
 	redisCli = redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: "", // no password set
-		DB:       0,  // use default DB
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
 
 	pong, err := redisCli.Ping().Result()
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println("redis pong:", pong, err)
+	log.Println("redis pong:", pong)
+}
+
+func CloseRedis() {
+	if err := redisCli.Close(); err != nil {
+		log.Println("close redis failed!err:=", err)
+	}
 }
 
-func testTunnelAlive(tunnel DaomonitTunnelStat) (bool, error) {
+func testTunnelAlive(tunnel DaomonitTunnelStat) (alive bool, err error) {
+	defer observeStage(stageTestTunnelAlive, time.Now(), &err)
 	cmd := redisCli.SIsMember(fmt.Sprintf("ngrok.%s", tunnel.Server), tunnel.PublicUrl)
 	return cmd.Result()
 }
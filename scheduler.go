@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scheduledNode is the schedule of one connected node.
+type scheduledNode struct {
+	Id       string
+	Due      time.Time
+	Interval time.Duration
+	Priority int
+	// Running is set from the submission of a run to its end, the node
+	// is out of the queue meanwhile.
+	Running     bool
+	LastSubmit  time.Time
+	LastFinish  time.Time
+	Runs        int64
+	Dropped     int64
+	Failures    int
+	ConnectedAt time.Time
+
+	index int
+}
+
+// nodeQueue is a heap of the waiting nodes ordered by due time.
+type nodeQueue []*scheduledNode
+
+func (q nodeQueue) Len() int { return len(q) }
+
+// Less orders by due time, then by priority, higher first.
+func (q nodeQueue) Less(i, j int) bool {
+	if q[i].Due.Equal(q[j].Due) {
+		return q[i].Priority > q[j].Priority
+	}
+	return q[i].Due.Before(q[j].Due)
+}
+
+func (q nodeQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *nodeQueue) Push(x interface{}) {
+	n := x.(*scheduledNode)
+	n.index = len(*q)
+	*q = append(*q, n)
+}
+
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	n := old[len(old)-1]
+	old[len(old)-1] = nil
+	n.index = -1
+	*q = old[:len(old)-1]
+	return n
+}
+
+// scheduler submits every connected node once per interval of its class.
+// Nodes known at startup are spread over their first interval, nodes
+// connecting later are due immediately. Later runs are due an interval
+// after the previous one ended plus a jitter of up to a tenth of the
+// interval, so nodes do not drift back into bursts; failed runs are
+// retried with the backoff of the collection state, and runs that find
+// the node collected recently, by another replica or before a restart,
+// come back when the collection state makes it due. Of the nodes due, those
+// of higher priority are submitted first and, when the pool is full, get
+// the next free slot.
+type scheduler struct {
+	submit func(id string) submitResult
+	wake   chan struct{}
+
+	mu     sync.Mutex
+	queue  nodeQueue
+	nodes  map[string]*scheduledNode
+	synced bool
+}
+
+func newScheduler(submit func(id string) submitResult) *scheduler {
+	return &scheduler{
+		submit: submit,
+		wake:   make(chan struct{}, 1),
+		nodes:  make(map[string]*scheduledNode),
+	}
+}
+
+func jitter(interval time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(interval)/10 + 1))
+}
+
+// Sync schedules the connected nodes of ids not known yet, forgets the
+// nodes no longer connected and applies class changes to the others.
+func (s *scheduler) Sync(ids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	connected := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		connected[id] = true
+		class := nodeCollectClass(id)
+		interval := time.Duration(class.Interval) * time.Second
+		if n, ok := s.nodes[id]; ok {
+			if n.Priority != class.Priority {
+				n.Priority = class.Priority
+				if !n.Running {
+					heap.Fix(&s.queue, n.index)
+				}
+			}
+			if n.Interval == interval {
+				continue
+			}
+			n.Interval = interval
+			// Bring a node moved to a shorter interval forward.
+			due := n.LastFinish.Add(interval)
+			if !n.Running && !n.LastFinish.IsZero() && due.Before(n.Due) {
+				n.Due = due
+				heap.Fix(&s.queue, n.index)
+			}
+			continue
+		}
+		n := &scheduledNode{Id: id, Due: now, Interval: interval, Priority: class.Priority, ConnectedAt: now}
+		if !s.synced {
+			n.Due = now.Add(time.Duration(rand.Int63n(int64(interval))))
+		}
+		s.nodes[id] = n
+		heap.Push(&s.queue, n)
+	}
+	s.synced = true
+	for id, n := range s.nodes {
+		if connected[id] {
+			continue
+		}
+		delete(s.nodes, id)
+		if !n.Running {
+			heap.Remove(&s.queue, n.index)
+		}
+	}
+	s.notify()
+}
+
+// Finished reschedules node id after a run, failed reporting whether the
+// collection failed and notDue how long the node was found not due yet.
+func (s *scheduler) Finished(id string, failed bool, notDue time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[id]
+	if !ok || !n.Running {
+		return
+	}
+	now := time.Now()
+	n.Running = false
+	n.LastFinish = now
+	n.Runs++
+	switch {
+	case failed:
+		n.Failures++
+		n.Due = now.Add(retryBackoff(n.Interval, n.Failures))
+	case notDue > 0:
+		// Due when the collection state says so rather than a whole
+		// interval from now.
+		n.Due = now.Add(notDue)
+	default:
+		n.Failures = 0
+		n.Due = now.Add(n.Interval + jitter(n.Interval))
+	}
+	heap.Push(&s.queue, n)
+	s.notify()
+}
+
+// retryBackoff doubles the retry backoff per consecutive failure up to
+// interval, like markNodeFailed.
+func retryBackoff(interval time.Duration, failures int) time.Duration {
+	backoff := time.Duration(conf.Collector.RetryBackoff) * time.Second
+	for i := 1; i < failures && backoff < interval; i++ {
+		backoff *= 2
+	}
+	if backoff > interval {
+		backoff = interval
+	}
+	return backoff
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run submits the nodes as they become due until quit is closed.
+func (s *scheduler) Run(quit <-chan struct{}) {
+	for {
+		wait := s.submitDue()
+		t := time.NewTimer(wait)
+		select {
+		case <-quit:
+			t.Stop()
+			return
+		case <-s.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// poolRetryWait is how long the scheduler waits at most before retrying a
+// full pool.
+const poolRetryWait = time.Second
+
+// submitDue submits the due nodes and returns the time until the next one
+// is due.
+func (s *scheduler) submitDue() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var due []*scheduledNode
+	for len(s.queue) > 0 && !s.queue[0].Due.After(now) {
+		due = append(due, heap.Pop(&s.queue).(*scheduledNode))
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].Priority > due[j].Priority
+	})
+	for i, n := range due {
+		n.LastSubmit = now
+		switch s.submit(n.Id) {
+		case submitAccepted:
+			n.Running = true
+			continue
+		case submitDuplicate:
+			// A run of the node from before it disconnected is still
+			// queued or running and collects it, come back an interval
+			// later.
+			n.Due = now.Add(n.Interval + jitter(n.Interval))
+			heap.Push(&s.queue, n)
+			continue
+		}
+		// The pool is full. Keep this node and the others left due, so
+		// the next free slot goes to the highest priority of all the due
+		// nodes rather than to the one due first. A finished run wakes
+		// the scheduler up, the slot frees when a worker takes the next
+		// queued node, which may be just after.
+		n.Dropped++
+		for _, m := range due[i:] {
+			heap.Push(&s.queue, m)
+		}
+		return poolRetryWait
+	}
+	if len(s.queue) == 0 {
+		// Sync wakes the scheduler up.
+		return time.Hour
+	}
+	return s.queue[0].Due.Sub(now)
+}
+
+// State returns a copy of the schedule of every node, by due time.
+func (s *scheduler) State() []scheduledNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := make([]scheduledNode, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		state = append(state, *n)
+	}
+	sort.Slice(state, func(i, j int) bool {
+		return state[i].Due.Before(state[j].Due)
+	})
+	return state
+}
+
+func (s *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.State())
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Stages of a collection whose calls are counted and timed.
+const (
+	stageListConnectedNodes = "list_connected_nodes"
+	stageGetNodeTunnel      = "get_node_tunnel"
+	stageTestTunnelAlive    = "test_tunnel_alive"
+	stageNewClient          = "new_client"
+	stageContainerList      = "container_list"
+	stageContainerStats     = "container_stats"
+	stageSinkWrite          = "sink_write"
+)
+
+// stageBuckets are the upper bounds in seconds of the latency histogram.
+var stageBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type stageKey struct {
+	stage  string
+	result string
+}
+
+// stageStat is cumulative since the collector started.
+type stageStat struct {
+	count   uint64
+	sum     float64
+	max     float64
+	buckets []uint64
+}
+
+// stageMetrics counts the calls of every stage by result, success or
+// failure, with a latency histogram. They are served on /metrics next to
+// the samples and, with collector.self_metrics, written to the sink as
+// collector_self samples.
+type stageMetrics struct {
+	mu     sync.Mutex
+	stages map[stageKey]*stageStat
+}
+
+var selfMetrics = &stageMetrics{stages: make(map[stageKey]*stageStat)}
+
+// observeStage records a call of stage that started at start and returned
+// *errp. It is meant to be deferred with the named error result of the
+// stage:
+//
+//	defer observeStage(stageNewClient, time.Now(), &err)
+func observeStage(stage string, start time.Time, errp *error) {
+	selfMetrics.observe(stage, time.Since(start).Seconds(), *errp)
+}
+
+func (m *stageMetrics) observe(stage string, seconds float64, err error) {
+	key := stageKey{stage: stage, result: "success"}
+	if err != nil {
+		key.result = "failure"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.stages[key]
+	if !ok {
+		st = &stageStat{buckets: make([]uint64, len(stageBuckets))}
+		m.stages[key] = st
+	}
+	st.count++
+	st.sum += seconds
+	if seconds > st.max {
+		st.max = seconds
+	}
+	for i, le := range stageBuckets {
+		if seconds <= le {
+			st.buckets[i]++
+		}
+	}
+}
+
+type stageSnapshot struct {
+	stageKey
+	stageStat
+}
+
+func (m *stageMetrics) snapshot() []stageSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := make([]stageSnapshot, 0, len(m.stages))
+	for key, st := range m.stages {
+		cp := *st
+		cp.buckets = append([]uint64(nil), st.buckets...)
+		snap = append(snap, stageSnapshot{key, cp})
+	}
+	sort.Slice(snap, func(i, j int) bool {
+		if snap[i].stage != snap[j].stage {
+			return snap[i].stage < snap[j].stage
+		}
+		return snap[i].result < snap[j].result
+	})
+	return snap
+}
+
+// writeProm writes the stages as the collector_stage_total counter and the
+// collector_stage_duration_seconds histogram.
+func (m *stageMetrics) writeProm(bw *bufio.Writer) {
+	snap := m.snapshot()
+	if len(snap) == 0 {
+		return
+	}
+	fmt.Fprintf(bw, "# TYPE collector_stage_total counter\n")
+	for _, s := range snap {
+		labels := promLabels(map[string]string{"stage": s.stage, "result": s.result})
+		fmt.Fprintf(bw, "collector_stage_total%s %d\n", labels, s.count)
+	}
+	fmt.Fprintf(bw, "# TYPE collector_stage_duration_seconds histogram\n")
+	for _, s := range snap {
+		for i, le := range stageBuckets {
+			labels := promLabels(map[string]string{"stage": s.stage, "result": s.result, "le": strconv.FormatFloat(le, 'g', -1, 64)})
+			fmt.Fprintf(bw, "collector_stage_duration_seconds_bucket%s %d\n", labels, s.buckets[i])
+		}
+		labels := promLabels(map[string]string{"stage": s.stage, "result": s.result, "le": "+Inf"})
+		fmt.Fprintf(bw, "collector_stage_duration_seconds_bucket%s %d\n", labels, s.count)
+		labels = promLabels(map[string]string{"stage": s.stage, "result": s.result})
+		fmt.Fprintf(bw, "collector_stage_duration_seconds_sum%s %s\n", labels, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "collector_stage_duration_seconds_count%s %d\n", labels, s.count)
+	}
+}
+
+// samples returns one collector_self sample per stage and result.
+func (m *stageMetrics) samples() []Sample {
+	snap := m.snapshot()
+	pts := make([]Sample, 0, len(snap))
+	for _, s := range snap {
+		tags := map[string]string{
+			"stage":      s.stage,
+			"result":     s.result,
+			"replica_id": conf.Collector.ReplicaId,
+		}
+		fields := map[string]interface{}{
+			"count":        s.count,
+			"duration_sum": s.sum,
+			"duration_max": s.max,
+			"duration_avg": s.sum / float64(s.count),
+		}
+		pts = append(pts, newSample("collector_self", tags, fields))
+	}
+	return pts
+}
+
+// writeSelfMetrics writes the collector_self samples to sink.
+func writeSelfMetrics(sink Sink) {
+	pts := selfMetrics.samples()
+	if len(pts) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := sink.Write(ctx, pts); err != nil {
+		log.Printf("write self metrics failed!err:=%v", err)
+	}
+}
+
+// observedSink times the writes of the sink it wraps.
+type observedSink struct {
+	Sink
+}
+
+func (s observedSink) Write(ctx context.Context, samples []Sample) (err error) {
+	defer observeStage(stageSinkWrite, time.Now(), &err)
+	return s.Sink.Write(ctx, samples)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Sample is one measurement produced by the collector, independent of the
+// backend it is written to.
+type Sample struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// Sink is an output for collected samples.
+type Sink interface {
+	Write(ctx context.Context, samples []Sample) error
+	Close() error
+}
+
+type sinkFactory func(cfg Config) (Sink, error)
+
+var sinkFactories = make(map[string]sinkFactory)
+
+// registerSink makes a sink available under name in the sinks setting.
+// It is meant to be called from init functions.
+func registerSink(name string, f sinkFactory) {
+	if _, ok := sinkFactories[name]; ok {
+		panic("sink " + name + " registered twice")
+	}
+	sinkFactories[name] = f
+}
+
+func sinkNames() []string {
+	names := make([]string, 0, len(sinkFactories))
+	for name := range sinkFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var metricSink Sink
+
+func InitSinks(cfg Config) {
+	var err error
+	metricSink, err = newSink(cfg)
+	if err != nil {
+		panic(err)
+	}
+	metricSink = observedSink{metricSink}
+}
+
+func newSink(cfg Config) (Sink, error) {
+	sinks := make(fanoutSink, 0, len(cfg.Sinks))
+	for _, name := range cfg.Sinks {
+		f, ok := sinkFactories[name]
+		if !ok {
+			sinks.Close()
+			return nil, fmt.Errorf("unknown sink %q", name)
+		}
+		s, err := f(cfg)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("sink %s: %v", name, err)
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+func newSample(measurement string, tags map[string]string, fields map[string]interface{}) Sample {
+	return Sample{
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        time.Now(),
+	}
+}
+
+// fanoutSink writes every batch to all of its sinks in parallel.
+type fanoutSink []Sink
+
+func (f fanoutSink) Write(ctx context.Context, samples []Sample) error {
+	errs := make([]error, len(f))
+	var wg sync.WaitGroup
+	for i := range f {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f[i].Write(ctx, samples)
+		}(i)
+	}
+	wg.Wait()
+	return joinErrors(errs)
+}
+
+func (f fanoutSink) Close() error {
+	errs := make([]error, len(f))
+	for i := range f {
+		errs[i] = f[i].Close()
+	}
+	return joinErrors(errs)
+}
+
+func joinErrors(errs []error) error {
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
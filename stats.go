@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// containerStats is a stats frame together with the fields newer engines
+// send that docker.Stats does not know about.
+type containerStats struct {
+	docker.Stats
+	OnlineCPUs uint32
+	PidsLimit  uint64
+	// TotalSwap is the total_swap of memory.stat, which docker.Stats
+	// leaves out.
+	TotalSwap uint64
+}
+
+func decodeStats(decoder *json.Decoder) (*containerStats, error) {
+	var raw json.RawMessage
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	s := new(containerStats)
+	err = json.Unmarshal(raw, &s.Stats)
+	if err != nil {
+		return nil, err
+	}
+	var extra struct {
+		CPUStats struct {
+			OnlineCPUs uint32 `json:"online_cpus"`
+		} `json:"cpu_stats"`
+		PidsStats struct {
+			Limit uint64 `json:"limit"`
+		} `json:"pids_stats"`
+		MemoryStats struct {
+			Stats map[string]uint64 `json:"stats"`
+		} `json:"memory_stats"`
+	}
+	err = json.Unmarshal(raw, &extra)
+	if err != nil {
+		return nil, err
+	}
+	s.OnlineCPUs = extra.CPUStats.OnlineCPUs
+	s.PidsLimit = extra.PidsStats.Limit
+	stat := extra.MemoryStats.Stats
+	if _, ok := stat["anon"]; ok {
+		// Engines on cgroup v2 send the v2 memory.stat keys.
+		v1 := make(map[string]uint64, len(memoryStatV2))
+		for k, name := range memoryStatV2 {
+			if v, ok := stat[k]; ok {
+				v1[name] = v
+			}
+		}
+		stat = v1
+	}
+	err = setMemoryStat(s, stat)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// containerSamples builds the samples of one container from its inspect
+// result and two consecutive stats frames. prev may be cur itself when no
+// earlier frame is known, rates are then left out.
+func containerSamples(tags map[string]string, info types.ContainerJSON, prev *containerStats, cur *containerStats) []Sample {
+	var hostConfig *container.HostConfig
+	if info.ContainerJSONBase != nil {
+		hostConfig = info.HostConfig
+	}
+	pts := []Sample{
+		newSample("docker_container_cpu", tags, cpuFields(cur, cpuLimitCores(hostConfig))),
+		newSample("docker_container_cpu_throttle", tags, cpuThrottleFields(cur)),
+		newSample("docker_container_mem", tags, memFields(cur)),
+		newSample("docker_container_pids", tags, pidsFields(cur, hostConfig)),
+	}
+	pts = append(pts, networkSamples(tags, prev, cur)...)
+	if conf.Collector.PerCoreCpu {
+		pts = append(pts, cpuCoreSamples(tags, cur)...)
+	}
+	return append(pts, blkioSamples(tags, prev, cur)...)
+}
+
+func calculateCpuPercent(previousCpu uint64, previousSystem uint64, currentCpu uint64, currentSystem uint64, cpuSize int) float64 {
+	cpuPercent := 0.0
+	cpuDelta := float64(currentCpu - previousCpu)
+	systemDelta := float64(currentSystem - previousSystem)
+
+	if cpuDelta > 0.0 && systemDelta > 0.0 {
+		cpuPercent = (cpuDelta / systemDelta) * float64(cpuSize)
+	}
+	return cpuPercent
+}
+
+// counterDelta returns the increase of a counter between two samples, zero
+// when the counter was reset.
+func counterDelta(prev uint64, cur uint64) uint64 {
+	if cur < prev {
+		return 0
+	}
+	return cur - prev
+}
+
+// perSecond returns the rate of a counter between two samples dt seconds
+// apart, zero when the counter was reset.
+func perSecond(prev uint64, cur uint64, dt float64) float64 {
+	if dt <= 0 || cur < prev {
+		return 0
+	}
+	return float64(cur-prev) / dt
+}
+
+// cpuSize is the number of CPUs usage percentages are scaled to. Per-CPU
+// usage is not reported on cgroup v2 hosts, online_cpus is used instead
+// when the engine sends it.
+func cpuSize(s *containerStats) int {
+	if s.OnlineCPUs > 0 {
+		return int(s.OnlineCPUs)
+	}
+	return len(s.CPUStats.CPUUsage.PercpuUsage)
+}
+
+// cpuLimitCores returns the number of CPUs a container may use according
+// to --cpus or --cpu-quota, zero when it is unlimited.
+func cpuLimitCores(hc *container.HostConfig) float64 {
+	if hc == nil {
+		return 0
+	}
+	if hc.NanoCPUs > 0 {
+		return float64(hc.NanoCPUs) / 1e9
+	}
+	if hc.CPUQuota > 0 {
+		period := hc.CPUPeriod
+		if period <= 0 {
+			// Kernel default CFS period.
+			period = 100000
+		}
+		return float64(hc.CPUQuota) / float64(period)
+	}
+	return 0
+}
+
+// cpuFields reports usage in CPUs, 1.0 being one fully used CPU, like the
+// *_percent fields always did. limit_ratio is usage relative to the CPU
+// limit, 1.0 meaning the whole grant is used. It is not named a percent
+// as the throttle, memory and pids *_percent fields are scaled to 100.
+func cpuFields(s *containerStats, limitCores float64) map[string]interface{} {
+	preSystemCpuUsage := s.PreCPUStats.SystemCPUUsage
+	systemCpuUsage := s.CPUStats.SystemCPUUsage
+	preCpuUsage := s.PreCPUStats.CPUUsage
+	cpuUsage := s.CPUStats.CPUUsage
+	cpuSize := cpuSize(s)
+	totalPercent := calculateCpuPercent(preCpuUsage.TotalUsage, preSystemCpuUsage, cpuUsage.TotalUsage, systemCpuUsage, cpuSize)
+	fields := map[string]interface{}{
+		"usermode_percent":    calculateCpuPercent(preCpuUsage.UsageInUsermode, preSystemCpuUsage, cpuUsage.UsageInUsermode, systemCpuUsage, cpuSize),
+		"kernelmode_percent":  calculateCpuPercent(preCpuUsage.UsageInKernelmode, preSystemCpuUsage, cpuUsage.UsageInKernelmode, systemCpuUsage, cpuSize),
+		"total_percent":       totalPercent,
+		"total_usage":         cpuUsage.TotalUsage,
+		"usage_in_usermode":   cpuUsage.UsageInUsermode,
+		"usage_in_kernelmode": cpuUsage.UsageInKernelmode,
+		"system_cpu_usage":    systemCpuUsage,
+		"cpu_size":            cpuSize,
+		"online_cpus":         s.OnlineCPUs,
+	}
+	if limitCores > 0 {
+		fields["limit_cores"] = limitCores
+		fields["limit_ratio"] = totalPercent / limitCores
+	}
+	return fields
+}
+
+// cpuThrottleFields reports CFS throttling counters; throttled_percent is
+// the share of periods throttled since the previous read of the engine.
+func cpuThrottleFields(s *containerStats) map[string]interface{} {
+	cur := s.CPUStats.ThrottlingData
+	pre := s.PreCPUStats.ThrottlingData
+	throttledPercent := 0.0
+	if cur.Periods > pre.Periods && cur.ThrottledPeriods >= pre.ThrottledPeriods {
+		throttledPercent = float64(cur.ThrottledPeriods-pre.ThrottledPeriods) / float64(cur.Periods-pre.Periods) * 100
+	}
+	return map[string]interface{}{
+		"periods":           cur.Periods,
+		"throttled_periods": cur.ThrottledPeriods,
+		"throttled_time":    cur.ThrottledTime,
+		"throttled_percent": throttledPercent,
+	}
+}
+
+// cpuCoreSamples emits one docker_container_cpu_core sample per CPU, on
+// the same scale as total_percent.
+func cpuCoreSamples(tags map[string]string, s *containerStats) []Sample {
+	cur := s.CPUStats.CPUUsage.PercpuUsage
+	pre := s.PreCPUStats.CPUUsage.PercpuUsage
+	cpuSize := cpuSize(s)
+	pts := make([]Sample, 0, len(cur))
+	for i := range cur {
+		var p uint64
+		if i < len(pre) {
+			p = pre[i]
+		}
+		fields := map[string]interface{}{
+			"usage":   cur[i],
+			"percent": calculateCpuPercent(p, s.PreCPUStats.SystemCPUUsage, cur[i], s.CPUStats.SystemCPUUsage, cpuSize),
+		}
+		pts = append(pts, newSample("docker_container_cpu_core", withTag(tags, "cpu", strconv.Itoa(i)), fields))
+	}
+	return pts
+}
+
+// hierarchical returns the total_* value of a memory.stat counter, which
+// includes child cgroups, or the plain one when the former is missing.
+func hierarchical(total uint64, local uint64) uint64 {
+	if total != 0 {
+		return total
+	}
+	return local
+}
+
+// memFields reports usage and the memory.stat breakdown. usage counts page
+// cache the kernel can reclaim; working_set leaves out the inactive file
+// cache and is what actually runs into the limit and the OOM killer.
+func memFields(s *containerStats) map[string]interface{} {
+	m := s.MemoryStats.Stats
+	inactiveFile := hierarchical(m.TotalInactiveFile, m.InactiveFile)
+	workingSet := s.MemoryStats.Usage
+	if workingSet > inactiveFile {
+		workingSet -= inactiveFile
+	} else {
+		workingSet = 0
+	}
+	usagePercent := 0.0
+	if s.MemoryStats.Limit > 0 {
+		usagePercent = float64(workingSet) / float64(s.MemoryStats.Limit) * 100
+	}
+	return map[string]interface{}{
+		"usage":         s.MemoryStats.Usage,
+		"limit":         s.MemoryStats.Limit,
+		"max_usage":     s.MemoryStats.MaxUsage,
+		"failcnt":       s.MemoryStats.Failcnt,
+		"rss":           hierarchical(m.TotalRss, m.Rss),
+		"cache":         hierarchical(m.TotalCache, m.Cache),
+		"swap":          hierarchical(s.TotalSwap, m.Swap),
+		"mapped_file":   hierarchical(m.TotalMappedFile, m.MappedFile),
+		"active_file":   hierarchical(m.TotalActiveFile, m.ActiveFile),
+		"inactive_file": inactiveFile,
+		"active_anon":   hierarchical(m.TotalActiveAnon, m.ActiveAnon),
+		"inactive_anon": hierarchical(m.TotalInactiveAnon, m.InactiveAnon),
+		// The total_pgmajfault field of docker.Stats is misspelled and
+		// never filled, only the local counter is available.
+		"pgmajfault":    m.Pgmajfault,
+		"working_set":   workingSet,
+		"usage_percent": usagePercent,
+	}
+}
+
+func networkTotals(s *containerStats) docker.NetworkStats {
+	var t docker.NetworkStats
+	for _, v := range s.Networks {
+		t.RxBytes += v.RxBytes
+		t.TxBytes += v.TxBytes
+		t.RxPackets += v.RxPackets
+		t.TxPackets += v.TxPackets
+		t.RxErrors += v.RxErrors
+		t.TxErrors += v.TxErrors
+		t.RxDropped += v.RxDropped
+		t.TxDropped += v.TxDropped
+	}
+	return t
+}
+
+// networkStatsFields reports the counters of cur, and rx_bandwidth and
+// tx_bandwidth as the integer byte delta since prev like they always were
+// with the rate in bytes per second over the dt seconds between them. The
+// deltas are over the window between the two frames, about a second in
+// stream mode but the time since the previous collection in oneshot mode
+// and in the agent, so only the rates compare across modes. Deltas and
+// rates are left out when there is no earlier frame.
+func networkStatsFields(prev docker.NetworkStats, cur docker.NetworkStats, dt float64) map[string]interface{} {
+	fields := map[string]interface{}{
+		"rx_bytes":   cur.RxBytes,
+		"tx_bytes":   cur.TxBytes,
+		"rx_packets": cur.RxPackets,
+		"tx_packets": cur.TxPackets,
+		"rx_errors":  cur.RxErrors,
+		"tx_errors":  cur.TxErrors,
+		"rx_dropped": cur.RxDropped,
+		"tx_dropped": cur.TxDropped,
+	}
+	if dt > 0 {
+		fields["rx_bandwidth"] = counterDelta(prev.RxBytes, cur.RxBytes)
+		fields["tx_bandwidth"] = counterDelta(prev.TxBytes, cur.TxBytes)
+		fields["rx_bytes_per_sec"] = perSecond(prev.RxBytes, cur.RxBytes, dt)
+		fields["tx_bytes_per_sec"] = perSecond(prev.TxBytes, cur.TxBytes, dt)
+	}
+	return fields
+}
+
+// networkSamples emits docker_container_network summed over all
+// interfaces and one docker_container_network_interface sample per
+// interface. Rates are per second over the time between the Read
+// timestamps of the two frames, an interface missing from prev has none.
+func networkSamples(tags map[string]string, prev *containerStats, cur *containerStats) []Sample {
+	dt := cur.Read.Sub(prev.Read).Seconds()
+	pts := []Sample{
+		newSample("docker_container_network", tags, networkStatsFields(networkTotals(prev), networkTotals(cur), dt)),
+	}
+	for name, n := range cur.Networks {
+		p, ok := prev.Networks[name]
+		ifaceDt := dt
+		if !ok {
+			ifaceDt = 0
+		}
+		pts = append(pts, newSample("docker_container_network_interface", withTag(tags, "interface", name), networkStatsFields(p, n, ifaceDt)))
+	}
+	return pts
+}
+
+// containerInfoFields describes a container and its lifecycle state, so
+// restarts and crash loops show up next to the resource samples.
+func containerInfoFields(c types.Container, info types.ContainerJSON) map[string]interface{} {
+	fields := map[string]interface{}{
+		"image":  c.Image,
+		"state":  c.State,
+		"status": c.Status,
+	}
+	if info.Config != nil {
+		fields["image"] = info.Config.Image
+	}
+	if info.ContainerJSONBase == nil {
+		return fields
+	}
+	fields["image_id"] = info.Image
+	fields["created"] = info.Created
+	fields["restart_count"] = info.RestartCount
+	if st := info.State; st != nil {
+		fields["state"] = st.Status
+		fields["running"] = st.Running
+		fields["started_at"] = st.StartedAt
+		fields["finished_at"] = st.FinishedAt
+		fields["exit_code"] = st.ExitCode
+		fields["oom_killed"] = st.OOMKilled
+		if started, err := time.Parse(time.RFC3339Nano, st.StartedAt); err == nil && st.Running {
+			fields["uptime"] = time.Since(started).Seconds()
+		}
+	}
+	return fields
+}
+
+// healthOutputLimit bounds the probe output kept in a health sample.
+const healthOutputLimit = 512
+
+// healthFields reports the healthcheck verdict of a container and the
+// result of its last probe.
+func healthFields(h *types.Health) map[string]interface{} {
+	fields := map[string]interface{}{
+		"status":         h.Status,
+		"healthy":        h.Status == types.Healthy,
+		"failing_streak": h.FailingStreak,
+	}
+	if n := len(h.Log); n > 0 && h.Log[n-1] != nil {
+		last := h.Log[n-1]
+		output := strings.TrimSpace(last.Output)
+		if len(output) > healthOutputLimit {
+			output = output[:healthOutputLimit]
+		}
+		fields["output"] = output
+		fields["exit_code"] = last.ExitCode
+		fields["checked_at"] = last.End.Format(time.RFC3339Nano)
+		fields["probe_duration"] = last.End.Sub(last.Start).Seconds()
+	}
+	return fields
+}
+
+// hostFields describes the engine of a node and its capacity. Container
+// counts include containers the label filter does not select.
+func hostFields(info types.Info, v types.Version) map[string]interface{} {
+	return map[string]interface{}{
+		"ncpu":               info.NCPU,
+		"mem_total":          info.MemTotal,
+		"containers":         info.Containers,
+		"containers_running": info.ContainersRunning,
+		"containers_paused":  info.ContainersPaused,
+		"containers_stopped": info.ContainersStopped,
+		"images":             info.Images,
+		"storage_driver":     info.Driver,
+		"kernel_version":     info.KernelVersion,
+		"docker_version":     v.Version,
+		"api_version":        v.APIVersion,
+	}
+}
+
+// pidsFields reports the number of tasks in the container and its pids
+// limit, zero when unlimited.
+func pidsFields(s *containerStats, hc *container.HostConfig) map[string]interface{} {
+	limit := s.PidsLimit
+	if limit == 0 && hc != nil && hc.PidsLimit > 0 {
+		limit = uint64(hc.PidsLimit)
+	}
+	fields := map[string]interface{}{
+		"current": s.PidsStats.Current,
+		"limit":   limit,
+	}
+	if limit > 0 {
+		fields["usage_percent"] = float64(s.PidsStats.Current) / float64(limit) * 100
+	}
+	return fields
+}
+
+// processSamples turns a docker top listing into one
+// docker_container_process sample per process, tagged by pid, with the ps
+// columns as string fields. At most limit processes are kept.
+func processSamples(tags map[string]string, top types.ContainerProcessList, limit int) []Sample {
+	pidCol := -1
+	for i, title := range top.Titles {
+		if title == "PID" {
+			pidCol = i
+		}
+	}
+	if pidCol < 0 {
+		return nil
+	}
+	pts := make([]Sample, 0)
+	for _, proc := range top.Processes {
+		if len(pts) >= limit {
+			break
+		}
+		if len(proc) != len(top.Titles) {
+			continue
+		}
+		fields := make(map[string]interface{}, len(proc))
+		for i, title := range top.Titles {
+			if i != pidCol {
+				fields[strings.ToLower(title)] = proc[i]
+			}
+		}
+		pts = append(pts, newSample("docker_container_process", withTag(tags, "pid", proc[pidCol]), fields))
+	}
+	return pts
+}
+
+// blkioTotalDevice is the device tag of the blkio sample summing all
+// devices.
+const blkioTotalDevice = "total"
+
+type blkioCounters struct {
+	readBytes   uint64
+	writeBytes  uint64
+	readOps     uint64
+	writeOps    uint64
+	waitTime    uint64
+	serviceTime uint64
+}
+
+// blkioByDevice sums the recursive blkio entries per major:minor device
+// and over all devices.
+func blkioByDevice(s *containerStats) map[string]*blkioCounters {
+	devs := map[string]*blkioCounters{blkioTotalDevice: {}}
+	add := func(entries []docker.BlkioStatsEntry, f func(c *blkioCounters, op string, v uint64)) {
+		for _, e := range entries {
+			dev := fmt.Sprintf("%d:%d", e.Major, e.Minor)
+			c, ok := devs[dev]
+			if !ok {
+				c = &blkioCounters{}
+				devs[dev] = c
+			}
+			op := strings.ToLower(e.Op)
+			f(c, op, e.Value)
+			f(devs[blkioTotalDevice], op, e.Value)
+		}
+	}
+	add(s.BlkioStats.IOServiceBytesRecursive, func(c *blkioCounters, op string, v uint64) {
+		switch op {
+		case "read":
+			c.readBytes += v
+		case "write":
+			c.writeBytes += v
+		}
+	})
+	add(s.BlkioStats.IOServicedRecursive, func(c *blkioCounters, op string, v uint64) {
+		switch op {
+		case "read":
+			c.readOps += v
+		case "write":
+			c.writeOps += v
+		}
+	})
+	add(s.BlkioStats.IOWaitTimeRecursive, func(c *blkioCounters, op string, v uint64) {
+		if op == "total" {
+			c.waitTime += v
+		}
+	})
+	add(s.BlkioStats.IOServiceTimeRecursive, func(c *blkioCounters, op string, v uint64) {
+		if op == "total" {
+			c.serviceTime += v
+		}
+	})
+	return devs
+}
+
+// blkioSamples emits one docker_container_blkio sample per device plus
+// one tagged device=total, with rates between the prev and cur frames.
+func blkioSamples(tags map[string]string, prev *containerStats, cur *containerStats) []Sample {
+	dt := cur.Read.Sub(prev.Read).Seconds()
+	prevDevs := blkioByDevice(prev)
+	pts := make([]Sample, 0)
+	for dev, c := range blkioByDevice(cur) {
+		p, ok := prevDevs[dev]
+		if !ok {
+			p = c
+		}
+		fields := map[string]interface{}{
+			"read_bytes":      c.readBytes,
+			"write_bytes":     c.writeBytes,
+			"read_ops":        c.readOps,
+			"write_ops":       c.writeOps,
+			"io_wait_time":    c.waitTime,
+			"io_service_time": c.serviceTime,
+		}
+		if dt > 0 {
+			fields["read_bytes_per_sec"] = perSecond(p.readBytes, c.readBytes, dt)
+			fields["write_bytes_per_sec"] = perSecond(p.writeBytes, c.writeBytes, dt)
+			fields["read_ops_per_sec"] = perSecond(p.readOps, c.readOps, dt)
+			fields["write_ops_per_sec"] = perSecond(p.writeOps, c.writeOps, dt)
+		}
+		pts = append(pts, newSample("docker_container_blkio", withTag(tags, "device", dev), fields))
+	}
+	return pts
+}
+
+// withTag returns a copy of tags with key set to value.
+func withTag(tags map[string]string, key string, value string) map[string]string {
+	t := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		t[k] = v
+	}
+	t[key] = value
+	return t
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDecodeStatsMemory(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		want  map[string]uint64
+	}{
+		{
+			name:  "cgroup v1",
+			frame: `{"memory_stats":{"stats":{"rss":200,"total_rss":300,"cache":100,"mapped_file":10,"swap":5,"total_swap":7}}}`,
+			want:  map[string]uint64{"rss": 300, "cache": 100, "mapped_file": 10, "swap": 7},
+		},
+		{
+			name:  "cgroup v2",
+			frame: `{"memory_stats":{"stats":{"anon":200,"file":100,"file_mapped":10,"inactive_file":40,"pgmajfault":3}}}`,
+			want:  map[string]uint64{"rss": 200, "cache": 100, "mapped_file": 10, "inactive_file": 40, "pgmajfault": 3, "swap": 0},
+		},
+	}
+	for _, tt := range tests {
+		s, err := decodeStats(json.NewDecoder(strings.NewReader(tt.frame)))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		fields := memFields(s)
+		for k, v := range tt.want {
+			if fields[k] != v {
+				t.Errorf("%s: %s = %v, want %d", tt.name, k, fields[k], v)
+			}
+		}
+	}
+}
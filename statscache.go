@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// statsCache keeps the last stats frame of every container so one-shot
+// collections can compute rates against the previous collection.
+type statsCache interface {
+	// Swap stores cur and returns the frame it replaces, nil when none
+	// is known or it expired.
+	Swap(containerId string, cur *containerStats) (*containerStats, error)
+}
+
+var containerStatsCache statsCache
+
+func InitStatsCache(cfg CollectorConfig) {
+	ttl := time.Duration(cfg.StatsCacheTTL) * time.Second
+	if ttl == 0 {
+		ttl = 3 * time.Duration(cfg.maxInterval()) * time.Second
+	}
+	switch cfg.StatsCache {
+	case "memory":
+		containerStatsCache = newMemoryStatsCache(ttl)
+	case "redis":
+		containerStatsCache = &redisStatsCache{cli: redisCli, ttl: ttl}
+	default:
+		panic(fmt.Sprintf("unknown stats cache %q", cfg.StatsCache))
+	}
+}
+
+type cachedStats struct {
+	stats  *containerStats
+	stored time.Time
+}
+
+type memoryStatsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedStats
+	pruned  time.Time
+}
+
+func newMemoryStatsCache(ttl time.Duration) *memoryStatsCache {
+	return &memoryStatsCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedStats),
+		pruned:  time.Now(),
+	}
+}
+
+func (m *memoryStatsCache) Swap(containerId string, cur *containerStats) (*containerStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	// Drop removed containers once per TTL.
+	if now.Sub(m.pruned) > m.ttl {
+		for id, e := range m.entries {
+			if now.Sub(e.stored) > m.ttl {
+				delete(m.entries, id)
+			}
+		}
+		m.pruned = now
+	}
+	prev, ok := m.entries[containerId]
+	m.entries[containerId] = cachedStats{stats: cur, stored: now}
+	if !ok || now.Sub(prev.stored) > m.ttl {
+		return nil, nil
+	}
+	return prev.stats, nil
+}
+
+// redisStatsCache shares the frames between collector replicas, so rates
+// survive a node moving to another replica.
+type redisStatsCache struct {
+	cli *redis.Client
+	ttl time.Duration
+}
+
+func (r *redisStatsCache) Swap(containerId string, cur *containerStats) (*containerStats, error) {
+	data, err := json.Marshal(cur)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("metrics.stats.%s", containerId)
+	pipe := r.cli.TxPipeline()
+	get := pipe.GetSet(key, data)
+	pipe.Expire(key, r.ttl)
+	_, err = pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	old, err := get.Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prev := new(containerStats)
+	err = json.Unmarshal(old, prev)
+	if err != nil {
+		return nil, err
+	}
+	return prev, nil
+}